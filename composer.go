@@ -21,16 +21,27 @@ package composer
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"mime"
+	"mime/multipart"
+	"net/http"
 	"net/textproto"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/prantlf/go-sizeio"
 )
@@ -40,21 +51,290 @@ import (
 type Composer struct {
 	// CloseReaders, if set to false, prevents closing of added files
 	// or readers when Close is called, or when the reader returned by
-	// DetachReader is closed. The initial value set by NewComposer is true.
+	// DetachReader is closed. The initial value set by NewComposer is
+	// DefaultCloseReaders.
+	// The value is captured for each part when it is added. It can be
+	// overridden for a particular part by AddFileReaderOwned. Files opened
+	// by AddFile, AddFiles and AddFileObject are always owned.
 	CloseReaders bool
 
-	boundary string
-	readers  []io.Reader
+	// CopyBufferSize, if set to a positive number, sets the size of the buffer
+	// used by WriteTo to copy the content of the readers to the writer.
+	// Otherwise the default size of io.Copy is used (32 KB).
+	CopyBufferSize int
+
+	// RejectDuplicateFields, if set to true, makes the Composer record
+	// an error, which can be checked by Err, if a part with an already used
+	// field name is added. Use AddFieldList to add multiple values
+	// of the same field intentionally.
+	RejectDuplicateFields bool
+
+	// JSONContentType, if set to true, makes AddJSONField insert the header
+	// "Content-Type: application/json" to the new part. Otherwise the part
+	// will be a plain form-data field.
+	JSONContentType bool
+
+	// HeaderFunc, if set, is called for the header of every part, except
+	// for raw parts, when the message is rendered by one of the DetachReader
+	// methods or when its size is computed. It can modify the header, for
+	// example, to add a tracing header to every part. The index is the
+	// position of the part in the message. Changes are not retained between
+	// the calls, the function receives a copy of the original header.
+	HeaderFunc func(index int, header textproto.MIMEHeader)
+
+	// JoinCloseErrors, if set to true, makes Close, and Close of the reader
+	// returned by the DetachReader methods, return all errors of failing
+	// readers in CloseErrors. Otherwise only the first error is returned.
+	JoinCloseErrors bool
+
+	// AssumeUTF8Text, if set to true, makes file parts with a textual content
+	// type ("text/*") inferred from the file extension declare the UTF-8
+	// charset, if the content type does not include any charset.
+	AssumeUTF8Text bool
+
+	// VerifySizes, if set to true, makes the reader returned by the DetachReader
+	// methods count the bytes produced by every reader declaring its size by
+	// sizeio.WithSize, like files added by AddFile. If a reader produces
+	// a different count of bytes than declared, for example, because the file
+	// was truncated after it had been added, Close of the detached reader
+	// returns an error. Readers, which were not read to the end, are not
+	// checked.
+	VerifySizes bool
+
+	// MaxSize, if set to a positive number, makes reading from the reader
+	// returned by the DetachReader methods fail, once the message turns out
+	// to be longer than MaxSize bytes, like DetachReaderLimited does.
+	MaxSize int64
+
+	// NoClosingDelimiter, if set to true, omits the closing boundary delimiter
+	// line at the end of the message, which is then ended by the content
+	// of the last part. WARNING: The message does not conform to RFC 2046
+	// and cannot be parsed by standard parsers. Use it only for proprietary
+	// endpoints, which rely on Content-Length instead.
+	NoClosingDelimiter bool
+
+	// SniffContentType, if set to true, makes AddFileObject and
+	// AddFileObjectNamed detect the content type from the first 512 bytes
+	// of the file, if the file extension does not have a known content type.
+	// It is useful for temporary files, which names are meaningless.
+	SniffContentType bool
+
+	// DispositionType is the type of the header Content-Disposition used by
+	// the methods creating parts, except for CreatePartWithType. The initial
+	// value set by NewComposer is "form-data". Some servers expect other
+	// types, like "attachment". An empty value means "form-data" too.
+	DispositionType string
+
+	// PreserveHeaderOrder, if set to true, makes parts added by AddPartOrdered
+	// write their header fields in the order in which they were specified.
+	// Otherwise, and for the other parts, header fields are sorted by their
+	// names.
+	PreserveHeaderOrder bool
+
+	// RFC2231Params, if set to true, makes the methods creating parts encode
+	// field and file names in Content-Disposition according to RFC 2231,
+	// if they contain non-ASCII characters, or if they are longer than
+	// 64 characters. Long names are split to continuations, like name*0*
+	// and name*1*. Otherwise the names are only quoted, which is what most
+	// servers expect.
+	RFC2231Params bool
+
+	// DefaultContentType is the content type of file parts, which content
+	// type cannot be inferred from the file extension, or detected by
+	// SniffContentType. The initial value set by NewComposer is
+	// "application/octet-stream". An empty value means the same.
+	DefaultContentType string
+
+	// SystemContentTypes, if set to true, makes the content type of file parts
+	// inferred only by mime.TypeByExtension, which depends on the MIME database
+	// of the operating system. Otherwise a built-in table of common web types
+	// is consulted first, which makes the inference the same on all platforms.
+	SystemContentTypes bool
+
+	// DelimiterPrefix is written before the boundary on the delimiter lines.
+	// The initial value set by NewComposer is "--", as required by RFC 2046.
+	// An empty value means "--" too. Use NoDelimiterPrefix to write bare
+	// boundaries on the delimiter lines.
+	// WARNING: Other values than "--" produce messages, which do not conform
+	// to RFC 2046 and cannot be parsed by standard parsers. Use them only for
+	// legacy systems, which require such framing.
+	DelimiterPrefix string
+
+	// NoDelimiterPrefix, if set to true, omits DelimiterPrefix, so that
+	// the delimiter lines contain only the boundary. WARNING: The message
+	// does not conform to RFC 2046, see DelimiterPrefix.
+	NoDelimiterPrefix bool
+
+	// Strict, if set to true, seals the Composer, once its message is detached
+	// by one of the DetachReader methods, WriteTo or WriteParts, like Seal.
+	// It catches mistakes, where a Composer meant for a single message
+	// is reused.
+	Strict bool
+
+	// TrailingSeparator is written between the content of the last part
+	// and the closing delimiter line, for example "\r\n" for servers, which
+	// expect an extra empty line there. It is not written if the closing
+	// delimiter line is omitted by NoClosingDelimiter. The initial value
+	// is empty, which writes nothing.
+	TrailingSeparator string
+
+	boundary        string
+	boundaryLength  int
+	boundaryPrefix  string
+	headerSize      int64 // sum of sizes of part headers
+	totalSizeFields int   // count of fields added by AddTotalSizeField
+	required        []string
+	redacted        []string
+	sealed          bool
+	parts           []*part
+	names           map[string]bool
+	err             error
+}
+
+// Part describes a section of the multipart message for inspection.
+type Part struct {
+	// Header contains the headers of the part. It is nil for raw parts
+	// added by AddRawPart. It must not be modified.
+	Header textproto.MIMEHeader
+	// Reader provides the content of the part for AddFromChannel. It is nil
+	// for parts passed for inspection.
+	Reader io.Reader
+}
+
+// Name returns the field name from the Content-Disposition header,
+// or an empty string if there is none.
+func (p Part) Name() string {
+	return p.dispositionParam("name")
+}
+
+// FileName returns the file name from the Content-Disposition header,
+// or an empty string if there is none.
+func (p Part) FileName() string {
+	return p.dispositionParam("filename")
+}
+
+func (p Part) dispositionParam(key string) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params[key]
+}
+
+// FieldsFirst returns a function for SortParts, which moves parts without
+// a file name before parts with a file name. The order of parts within both
+// groups is retained.
+func FieldsFirst() func(a, b Part) bool {
+	return func(a, b Part) bool {
+		return a.FileName() == "" && b.FileName() != ""
+	}
 }
 
+// DataURI reads the whole content of the reader and returns it encoded
+// as a data URI with base64: "data:<content type>;base64,<data>". If the
+// content type is empty, "application/octet-stream" is used, the same
+// as for file parts with an unknown file extension. It is meant for small
+// contents only, because the whole content is read to memory.
+func DataURI(reader io.Reader, contentType string) (string, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return "data:" + contentType + ";base64," +
+		base64.StdEncoding.EncodeToString(content), nil
+}
+
+// part is a section of the multipart message. Its header is rendered
+// together with the boundary delimiter line when the message is detached.
+type part struct {
+	header  textproto.MIMEHeader
+	readers []io.Reader
+	// raw parts include the rendered header in the content, their header
+	// is not written
+	raw bool
+	// owned parts have their readers closed by Close or by the detached
+	// reader; set from CloseReaders when the part is added by default
+	owned bool
+	// order of header keys set by AddPartOrdered, used if PreserveHeaderOrder
+	// is set
+	order []string
+	// totalSize is set for fields added by AddTotalSizeField
+	totalSize bool
+	// path of the file opened by AddFile or AddFiles as the first reader,
+	// used by DetachReaderReplayable to open the file again
+	path string
+	// headerSize is the size of the rendered header, zero for raw parts
+	headerSize int64
+}
+
+// DefaultCloseReaders is the initial value of CloseReaders set by NewComposer.
+// It can be changed once, for example, in an init function, if the lifetime
+// of readers is managed elsewhere in the application.
+var DefaultCloseReaders = true
+
 // NewComposer returns a new multipart message Composer with a random
-// boundary.
+// boundary. Options can modify the initial configuration:
+//
+//     comp := composer.NewComposer(composer.WithoutCloseReaders())
 //
 // If you are going to add parts with readers that needs closing (files),
 // defer a call to Close in case an error occurs, the best right after
 // calling this method.
-func NewComposer() *Composer {
-	return &Composer{boundary: randomBoundary(), CloseReaders: true}
+func NewComposer(opts ...Option) *Composer {
+	c := &Composer{boundary: randomBoundary(defaultBoundaryLength), CloseReaders: DefaultCloseReaders,
+		DispositionType: "form-data", DefaultContentType: "application/octet-stream",
+		DelimiterPrefix: "--"}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewComposerWithBoundaryLength returns a new multipart message Composer
+// with a random boundary generated from the given count of random bytes.
+// The boundary consists of hexadecimal digits, twice as many as the bytes.
+// Shorter boundaries decrease the message overhead, longer ones decrease
+// the probability of collisions with the content. The count must be
+// between 1 and 35, so that the boundary does not exceed the 70 characters
+// allowed by RFC 2046. NewComposer uses 30 bytes. ResetBoundary keeps
+// the length.
+func NewComposerWithBoundaryLength(bytes int) (*Composer, error) {
+	if bytes < 1 || bytes > maxBoundaryLength {
+		return nil, ErrInvalidBoundaryLength
+	}
+	c := NewComposer()
+	c.boundary = randomBoundary(bytes)
+	c.boundaryLength = bytes
+	return c, nil
+}
+
+// NewFrom returns a new empty multipart message Composer with
+// the configuration of the template, like CloseReaders, DefaultContentType
+// or the length and the prefix of random boundaries. The new Composer
+// gets a new random boundary and no parts are copied. It allows defining
+// a profile once and creating Composers from it.
+func NewFrom(template *Composer) *Composer {
+	c := *template
+	c.required = append([]string(nil), template.required...)
+	c.redacted = append([]string(nil), template.redacted...)
+	c.resetParts()
+	c.err = nil
+	c.sealed = false
+	c.boundary = c.boundaryPrefix + randomBoundary(c.randomLength())
+	return &c
+}
+
+// Seal prevents further changes of the Composer. Adding parts records
+// ErrSealed, which can be checked by Err, and changing the boundary returns
+// ErrSealed. The readers passed to the add methods are not added and
+// the files opened by them, or the readers, which would be owned by
+// the Composer, are closed. The sealed Composer cannot be
+// unsealed, but NewFrom can create a new unsealed Composer from it.
+func (c *Composer) Seal() {
+	c.sealed = true
 }
 
 // Boundary returns the Composer's boundary.
@@ -70,45 +350,126 @@ func (c *Composer) Boundary() string {
 // contain certain ASCII characters, and must be non-empty and
 // at most 70 bytes long. (See RFC 2046, section 5.1.1.)
 func (c *Composer) SetBoundary(boundary string) error {
-	if len(c.readers) > 0 {
-		return errors.New("multipart: SetBoundary called after add")
+	if c.sealed {
+		return ErrSealed
 	}
-	// rfc2046#section-5.1.1
-	if len(boundary) < 1 || len(boundary) > 70 {
-		return errors.New("multipart: invalid boundary length")
+	if len(c.parts) > 0 {
+		return ErrSetBoundaryAfterAdd
 	}
-	end := len(boundary) - 1
-	for i, c := range boundary {
-		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
-			continue
-		}
-		switch c {
-		case '\'', '(', ')', '+', '_', ',', '-', '.', '/', ':', '=', '?':
-			continue
-		case ' ':
-			if i != end {
-				continue
-			}
-		}
-		return errors.New("multipart: invalid boundary character")
+	if err := validateBoundary(boundary); err != nil {
+		return err
 	}
 	c.boundary = boundary
 	return nil
 }
 
+// SetBoundaryFromContentType overrides the Composer's initial boundary
+// separator with the boundary parameter of a multipart content type,
+// for example "multipart/form-data; boundary=...".
+//
+// It fails if the content type cannot be parsed, if it is not multipart,
+// or if the boundary is missing. The boundary is validated by SetBoundary.
+func (c *Composer) SetBoundaryFromContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return ErrNotMultipart
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return ErrBoundaryMissing
+	}
+	return c.SetBoundary(boundary)
+}
+
 // ResetBoundary overrides the Composer's current boundary separator
 // with a randomly generared one.
 //
 // ResetBoundary must be called before any parts are added, or after all
 // parts were detached by one of the DetachReader methods.
 func (c *Composer) ResetBoundary() error {
-	if len(c.readers) > 0 {
-		return errors.New("multipart: RandomizeBoundary called after add")
+	if c.sealed {
+		return ErrSealed
+	}
+	if len(c.parts) > 0 {
+		return ErrSetBoundaryAfterAdd
+	}
+	c.boundary = c.boundaryPrefix + randomBoundary(c.randomLength())
+	return nil
+}
+
+// SetBoundaryPrefix sets the prefix of randomly generated boundaries
+// and replaces the current boundary with a new one, which starts with
+// the prefix, like "level1-<random>". It makes dumps of nested messages
+// better readable. The prefix may contain only the characters allowed
+// in a boundary and the whole boundary must not exceed 70 characters,
+// which leaves 10 characters for the prefix with the default length
+// of the random part. ResetBoundary keeps the prefix.
+//
+// SetBoundaryPrefix must be called before any parts are added, or after all
+// parts were detached by one of the DetachReader methods.
+func (c *Composer) SetBoundaryPrefix(prefix string) error {
+	if c.sealed {
+		return ErrSealed
+	}
+	if len(c.parts) > 0 {
+		return ErrSetBoundaryAfterAdd
+	}
+	boundary := prefix + randomBoundary(c.randomLength())
+	if err := validateBoundary(boundary); err != nil {
+		return err
 	}
-	c.boundary = randomBoundary()
+	c.boundary = boundary
+	c.boundaryPrefix = prefix
 	return nil
 }
 
+// randomLength returns the count of random bytes for generating boundaries.
+func (c *Composer) randomLength() int {
+	if c.boundaryLength == 0 {
+		return defaultBoundaryLength
+	}
+	return c.boundaryLength
+}
+
+// Err returns the first error recorded while adding parts to the Composer,
+// for example, if a nil reader was passed to an add method, or if
+// RejectDuplicateFields is set and a field name was used more than once.
+// Parts with nil readers are not added. Clear resets the error.
+func (c *Composer) Err() error {
+	return c.err
+}
+
+// BoundaryLine returns the line which starts every part of the multipart
+// message, exactly as the Composer emits it: "--<boundary>\r\n". Parts
+// following another part are preceded by an additional "\r\n". The leading
+// dashes are DelimiterPrefix, unless NoDelimiterPrefix is set.
+func (c *Composer) BoundaryLine() []byte {
+	return []byte(c.delimiterPrefix() + c.boundary + "\r\n")
+}
+
+// ClosingBoundaryLine returns the line which ends the multipart message,
+// exactly as the Composer emits it: "\r\n--<boundary>--\r\n". The leading
+// dashes are DelimiterPrefix, unless NoDelimiterPrefix is set.
+func (c *Composer) ClosingBoundaryLine() []byte {
+	return []byte("\r\n" + c.delimiterPrefix() + c.boundary + "--\r\n")
+}
+
+// BoundaryOverhead computes the count of bytes, which the boundary delimiter
+// lines add to a message with the given count of parts, including the line
+// breaks separating the parts and the closing delimiter line. It helps
+// choosing a shorter boundary for messages with a tight size budget.
+func (c *Composer) BoundaryOverhead(partCount int) int64 {
+	overhead := int64(len(c.closingLine()))
+	if partCount > 0 {
+		overhead += int64(partCount) * int64(len(c.BoundaryLine()))
+		overhead += int64(partCount-1) * 2
+	}
+	return overhead
+}
+
 // FormDataContentType returns the value of Content-Type for an HTTP request
 // with the body prepared by this Composer. It will include the constant
 // "multipart/form-data" and this Composers's Boundary.
@@ -122,15 +483,24 @@ func (c *Composer) FormDataContentType() string {
 	return "multipart/form-data; boundary=" + boundary
 }
 
-// CreateFilePart creates a new general multipart section, but does not add
+// CreatePart creates a new general multipart section, but does not add
 // it to the composer yet.
 // Passing the returned header to AddPart will add it to the composer.
 func (c *Composer) CreatePart(disposition map[string]string) textproto.MIMEHeader {
+	return c.CreatePartWithType(c.dispositionType(), disposition)
+}
+
+// CreatePartWithType creates a new general multipart section with
+// the given disposition type, like "attachment" or "inline", but does not
+// add it to the composer yet. It is meant for other multipart messages than
+// form-data, like multipart/mixed.
+// Passing the returned header to AddPart will add it to the composer.
+func (c *Composer) CreatePartWithType(dispositionType string, disposition map[string]string) textproto.MIMEHeader {
 	head := make(textproto.MIMEHeader)
 	var buf bytes.Buffer
-	fmt.Fprint(&buf, "form-data")
+	fmt.Fprint(&buf, dispositionType)
 	for key, val := range disposition {
-		fmt.Fprintf(&buf, `; %s="%s"`, key, escapeQuotes(val))
+		buf.WriteString(c.dispositionParam(key, val))
 	}
 	head.Set("Content-Disposition", buf.String())
 	return head
@@ -141,8 +511,7 @@ func (c *Composer) CreatePart(disposition map[string]string) textproto.MIMEHeade
 // Passing the returned header to AddPart will add it to the composer.
 func (c *Composer) CreateFieldPart(name string) textproto.MIMEHeader {
 	head := make(textproto.MIMEHeader)
-	head.Set("Content-Disposition", fmt.Sprintf(
-		"form-data; name=\"%s\"", escapeQuotes(name)))
+	head.Set("Content-Disposition", c.dispositionType()+c.dispositionParam("name", name))
 	return head
 }
 
@@ -151,220 +520,2210 @@ func (c *Composer) CreateFieldPart(name string) textproto.MIMEHeader {
 // Passing the returned header to AddPart will add it to the composer.
 func (c *Composer) CreateFilePart(fieldName, fileName string) textproto.MIMEHeader {
 	head := make(textproto.MIMEHeader)
-	contentType := mime.TypeByExtension(filepath.Ext(fileName))
-	if contentType == "" {
-		contentType = "application/octet-stream"
-	}
-	head.Set("Content-Disposition", fmt.Sprintf(
-		"form-data; name=\"%s\"; filename=\"%s\"", escapeQuotes(fieldName), escapeQuotes(fileName)))
+	contentType := c.fileContentType(fileName)
+	head.Set("Content-Disposition", c.dispositionType()+
+		c.dispositionParam("name", fieldName)+c.dispositionParam("filename", fileName))
 	head.Set("Content-Type", contentType)
 	return head
 }
 
+// CreateFilePartWithTypeParams works like CreateFilePart, but it merges
+// the given parameters to the content type inferred from the file
+// extension, for example, "text/plain; charset=utf-8; name=x". The given
+// parameters override the inferred ones. If the content type cannot be
+// formatted with the parameters, the inferred one is used.
+func (c *Composer) CreateFilePartWithTypeParams(fieldName, fileName string, typeParams map[string]string) textproto.MIMEHeader {
+	head := c.CreateFilePart(fieldName, fileName)
+	mediaType, params, err := mime.ParseMediaType(head.Get("Content-Type"))
+	if err != nil {
+		return head
+	}
+	for key, value := range typeParams {
+		params[key] = value
+	}
+	if contentType := mime.FormatMediaType(mediaType, params); contentType != "" {
+		head.Set("Content-Type", contentType)
+	}
+	return head
+}
+
 // AddPart creates a new multipart section prepared earlier with CreatePart,
 // CreateFieldPart or CreateFilePart.
 // It inserts all headers prepared earlier and then appends the value reader.
 func (c *Composer) AddPart(header textproto.MIMEHeader, reader io.Reader) {
-	var buf bytes.Buffer
-	var delimiter string
-	if len(c.readers) > 0 {
-		delimiter = "\r\n"
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddPart", ErrNilReader))
+		return
 	}
-	fmt.Fprintf(&buf, "%s--%s\r\n", delimiter, c.boundary)
-	keys := make([]string, 0, len(header))
-	for key := range header {
-		keys = append(keys, key)
+	if c.rejectSealed(c.CloseReaders, reader) {
+		return
 	}
-	sort.Strings(keys)
-	for _, key := range keys {
-		for _, val := range header[key] {
-			fmt.Fprintf(&buf, "%s: %s\r\n", key, val)
+	header = canonicalHeader(header)
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		if name, ok := params["name"]; ok {
+			c.useName(name)
+		}
+	}
+	c.appendPart(header, reader)
+}
+
+// HeaderField is a single field of a part header for AddPartOrdered.
+type HeaderField struct {
+	Key   string
+	Value string
+}
+
+// InsertPart works like AddPart, but it inserts the new multipart section
+// at the index among the parts added so far, instead of appending it. It
+// allows adding parts produced out of order. The index must be between zero
+// and the count of parts, otherwise an error will be recorded and returned
+// by Err.
+func (c *Composer) InsertPart(index int, header textproto.MIMEHeader, reader io.Reader) {
+	if index < 0 || index > len(c.parts) {
+		c.fail(fmt.Errorf("%w: %d", ErrInvalidPartIndex, index))
+		return
+	}
+	c.insert(index, func() { c.AddPart(header, reader) })
+}
+
+// AddPartOrdered creates a new multipart section with the header fields
+// in the given order, which is retained in the output if PreserveHeaderOrder
+// is set. Fields with the same key are grouped together at the position
+// of the first of them. It is meant for servers sensitive to the order
+// of header fields.
+func (c *Composer) AddPartOrdered(fields []HeaderField, reader io.Reader) {
+	header := make(textproto.MIMEHeader, len(fields))
+	order := make([]string, 0, len(fields))
+	for _, field := range fields {
+		key := textproto.CanonicalMIMEHeaderKey(field.Key)
+		if _, ok := header[key]; !ok {
+			order = append(order, key)
 		}
+		header.Add(key, field.Value)
+	}
+	count := len(c.parts)
+	c.AddPart(header, reader)
+	if len(c.parts) > count {
+		c.parts[count].order = order
+	}
+}
+
+// AddFromMultipartReader copies the parts of a multipart message from
+// the reader to this Composer, which renders them with its boundary.
+// The parts are streamed, when the message is read, so that their content
+// is not buffered. The transform function, if not nil, is called for every
+// part before it is written. It can modify the part header, or return false
+// to skip the part. The parts are not considered by RejectDuplicateFields
+// and the size of the message will not be available.
+func (c *Composer) AddFromMultipartReader(r *multipart.Reader, transform func(*multipart.Part) bool) error {
+	if r == nil {
+		return fmt.Errorf("%w passed to AddFromMultipartReader", ErrNilReader)
+	}
+	c.appendRawPart(&multipartStream{next: multipartReaderParts(r, transform),
+		boundary: c.BoundaryLine(), owned: true})
+	return nil
+}
+
+// AddFromChannel adds the parts received from the channel after the parts
+// added so far and detaches the reader of the whole message, like
+// DetachReader. Reading from the message blocks until the next part is
+// received. The closing boundary is written once the channel is closed.
+// The header of the received parts is written as-is, a nil header as
+// an empty one, and their content is read from their Reader. The size
+// of the message will not be available.
+//
+// The received readers will be owned by the Composer according
+// to CloseReaders. A reader is closed once its content is exhausted.
+func (c *Composer) AddFromChannel(ch <-chan Part) io.ReadCloser {
+	if ch == nil {
+		c.fail(fmt.Errorf("%w passed to AddFromChannel", ErrNilReader))
+	} else {
+		c.appendRawPart(&multipartStream{next: channelParts(ch),
+			boundary: c.BoundaryLine(), owned: c.CloseReaders})
 	}
-	fmt.Fprintf(&buf, "\r\n")
-	c.readers = append(c.readers, bytes.NewReader(buf.Bytes()), reader)
+	return c.DetachReader()
+}
+
+// AddRawPart creates a new multipart section from already rendered bytes.
+// The composer only inserts the boundary delimiter line, the data have to
+// contain the part headers, the empty line separating them and the content.
+// The data are not copied and must not be modified until the message
+// is read.
+//
+// The caller is responsible for the correctness of the data. They are not
+// validated and the field name in them is not considered
+// by RejectDuplicateFields.
+func (c *Composer) AddRawPart(data []byte) {
+	c.appendRawPart(bytes.NewReader(data))
+}
+
+// RawPart is a field section rendered in advance by PrecomputedField,
+// which can be added to many composers by AddRaw.
+type RawPart struct {
+	name string
+	data []byte
+}
+
+// PrecomputedField renders a field section with the name and value once,
+// so that it can be added to many composers by AddRaw without formatting
+// and escaping the header again. The section is rendered with the default
+// configuration of NewComposer, regardless of the composers it is added to.
+func PrecomputedField(name, value string) RawPart {
+	var buf bytes.Buffer
+	writeHeader(&buf, (&Composer{}).CreateFieldPart(name), nil)
+	buf.WriteString(value)
+	return RawPart{name, buf.Bytes()}
+}
+
+// AddRaw adds a field section rendered by PrecomputedField. Unlike
+// AddRawPart, the field name is considered by RejectDuplicateFields.
+func (c *Composer) AddRaw(part RawPart) {
+	c.useName(part.name)
+	c.AddRawPart(part.data)
 }
 
 // AddField creates a new multipart section with a field value.
 // It inserts a header with the provided field name and value.
 func (c *Composer) AddField(name, value string) {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "%s--%s\r\nContent-Disposition: form-data; name=\"%s\"\r\n\r\n%s",
-		c.delimiter(), c.boundary, escapeQuotes(name), value)
-	c.readers = append(c.readers, bytes.NewReader(buf.Bytes()))
+	c.useName(name)
+	c.addField(name, value)
+}
+
+// AddFieldIf works like AddField, if cond is true. Otherwise it does
+// nothing. It is useful for optional fields.
+func (c *Composer) AddFieldIf(cond bool, name, value string) {
+	if cond {
+		c.AddField(name, value)
+	}
+}
+
+// AddFieldTrimmed works like AddField, but it removes a single trailing
+// line break ("\n" or "\r\n") from the value first. It is useful for values
+// read from files or command output.
+func (c *Composer) AddFieldTrimmed(name, value string) {
+	if strings.HasSuffix(value, "\n") {
+		value = strings.TrimSuffix(value[:len(value)-1], "\r")
+	}
+	c.AddField(name, value)
+}
+
+// AddFieldStripBOM works like AddField, but it removes a leading UTF-8
+// byte order mark (U+FEFF) from the value first. It is useful for values
+// read from files exported by Windows applications.
+func (c *Composer) AddFieldStripBOM(name, value string) {
+	c.AddField(name, strings.TrimPrefix(value, "\uFEFF"))
+}
+
+// AddFieldExpanded works like AddField, but it replaces ${VAR} or $VAR
+// in the value with values of environment variables first. Undefined
+// variables are replaced by empty strings.
+func (c *Composer) AddFieldExpanded(name, value string) {
+	c.AddField(name, os.ExpandEnv(value))
+}
+
+// AddFieldList creates a new multipart section for each of the field values.
+// It is meant for array fields, which use the same field name intentionally,
+// and it is not considered a duplicate by RejectDuplicateFields.
+func (c *Composer) AddFieldList(name string, values []string) {
+	for _, value := range values {
+		c.addField(name, value)
+	}
+	c.markName(name)
+}
+
+func (c *Composer) addField(name, value string) {
+	c.appendPart(c.CreateFieldPart(name), strings.NewReader(value))
 }
 
 // AddFieldReader creates a new multipart section with a field value.
 // It inserts a header using the given field name and then appends
 // the value reader.
 func (c *Composer) AddFieldReader(name string, reader io.Reader) {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "%s--%s\r\nContent-Disposition: form-data; name=\"%s\"\r\n\r\n",
-		c.delimiter(), c.boundary, escapeQuotes(name))
-	c.readers = append(c.readers, bytes.NewReader(buf.Bytes()), reader)
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFieldReader", ErrNilReader))
+		return
+	}
+	c.useName(name)
+	c.appendPart(c.CreateFieldPart(name), reader)
 }
 
-// AddFile is a convenience wrapper around AddFileReader. It opens the given
-// file and uses its name, stats and content to create the new part.
+// AddFieldPipe works like AddFieldReader, but it declares the size
+// of the content produced by the writing end of the pipe, so that the size
+// of the message can be computed. The size has to be exact, otherwise
+// the request will fail or hang. Setting VerifySizes helps detecting it.
+func (c *Composer) AddFieldPipe(name string, r *io.PipeReader, size int64) {
+	if r == nil {
+		c.fail(fmt.Errorf("%w passed to AddFieldPipe", ErrNilReader))
+		return
+	}
+	c.AddFieldReader(name, withSize(r, size))
+}
+
+// AddFieldReaderNamed creates a new multipart section with a field value
+// and a file name. It inserts a header using the given field name and file
+// name, but no content type, and then appends the value reader.
 //
-// The opened file wil be owned by the Composer. Do not forget to close
-// the composer, once you do not need it, or defer the closure to perform
-// it automatically in case of a failure.
-func (c *Composer) AddFile(fieldName, filePath string) error {
-	if !c.CloseReaders {
-		return errors.New("multipart: adding file by path forbidden")
+// Some servers treat every part with a file name as a file. Use AddFileReader
+// to include the content type inferred from the file extension too.
+func (c *Composer) AddFieldReaderNamed(name, fileName string, reader io.Reader) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFieldReaderNamed", ErrNilReader))
+		return
 	}
-	reader, err := sizeio.OpenFile(filePath)
-	if err != nil {
+	c.useName(name)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", c.dispositionType()+
+		c.dispositionParam("name", name)+c.dispositionParam("filename", fileName))
+	c.appendPart(header, reader)
+}
+
+// AddFieldReaderWithType creates a new multipart section with a field value
+// of the given content type. It inserts a header using the given field name
+// and content type, but no file name, and then appends the value reader.
+func (c *Composer) AddFieldReaderWithType(name, contentType string, reader io.Reader) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFieldReaderWithType", ErrNilReader))
+		return
+	}
+	c.useName(name)
+	header := c.CreateFieldPart(name)
+	header.Set("Content-Type", contentType)
+	c.appendPart(header, reader)
+}
+
+// AddJSONField creates a new multipart section with a field value
+// serialized to JSON. It inserts a header with the provided field name,
+// and if JSONContentType is set, also with the JSON content type.
+// It fails if the value cannot be serialized to JSON.
+func (c *Composer) AddJSONField(name string, value interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(value); err != nil {
 		return err
 	}
-	c.AddFileReader(fieldName, filepath.Base(filePath), reader)
+	// json.Encoder terminates each value with a line break
+	reader := bytes.NewReader(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	if c.JSONContentType {
+		c.AddFieldReaderWithType(name, "application/json", reader)
+	} else {
+		c.AddFieldReader(name, reader)
+	}
 	return nil
 }
 
-// AddFileObject is a convenience wrapper around AddFileReader. It uses
-// the name, stats and content of the opened file to create the new part.
+// AddGroupMarker creates a new multipart section with no content, which
+// marks the end of a group of parts. It inserts a header with the provided
+// field name and the header "X-Group: end".
+func (c *Composer) AddGroupMarker(name string) {
+	header := c.CreateFieldPart(name)
+	header.Set("X-Group", "end")
+	c.AddPart(header, bytes.NewReader(nil))
+}
+
+// AddTotalSizeField creates a new multipart section for a field, which
+// value will be the total size of the message. The value is computed when
+// the message is detached, or when Size is called. The size excludes
+// the section of the field itself, as if the field was not added. If some
+// reader does not provide its size, Size will fail and reading from
+// the detached message will fail with ErrReaderWithoutSize.
+func (c *Composer) AddTotalSizeField(name string) {
+	c.useName(name)
+	if c.appendPart(c.CreateFieldPart(name), &errorReader{ErrReaderWithoutSize}) {
+		c.parts[len(c.parts)-1].totalSize = true
+		c.totalSizeFields++
+	}
+}
+
+// AddGraphQLUpload creates multipart sections according to the GraphQL
+// multipart request specification (https://github.com/jaydenseric/graphql-multipart-request-spec).
+// It adds the field "operations" with the JSON-serialized operations,
+// the field "map" with the JSON-serialized map of files to variable paths
+// and the file parts named "0", "1" etc. with the content of the readers.
 //
-// The opened file wil be owned by the Composer. Do not forget to close
-// the composer, once you do not need it, or defer the closure to perform
-// it automatically in case of a failure. However, do not close the source
-// file. The reader taking part in the request body creation would fail.
-func (c *Composer) AddFileObject(fieldName string, file *os.File) error {
-	stat, err := file.Stat()
+// The keys of the file map have to be the indexes of the file readers,
+// for example: {"0": ["variables.file"]}. The method fails if some file
+// reader is nil, if the map contains an unknown file index, or if
+// the operations or the map cannot be serialized to JSON. Nothing is added
+// to the composer in that case.
+func (c *Composer) AddGraphQLUpload(operations interface{}, fileMap map[string][]string, files []io.Reader) error {
+	for _, file := range files {
+		if file == nil {
+			return fmt.Errorf("%w passed to AddGraphQLUpload", ErrNilReader)
+		}
+	}
+	for key := range fileMap {
+		if index, err := strconv.Atoi(key); err != nil || index < 0 || index >= len(files) {
+			return fmt.Errorf("%w %q in the file map", ErrUnknownFileIndex, key)
+		}
+	}
+	ops, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	paths, err := json.Marshal(fileMap)
 	if err != nil {
 		return err
 	}
-	c.AddFileReader(fieldName, stat.Name(), sizeio.SizeReadCloser(file, stat.Size()))
+	c.AddFieldReader("operations", bytes.NewReader(ops))
+	c.AddFieldReader("map", bytes.NewReader(paths))
+	for i, file := range files {
+		name := strconv.Itoa(i)
+		c.AddFileReader(name, name, file)
+	}
 	return nil
 }
 
-// AddFileReader creates a new multipart section with a file content.
-// It inserts a header using the given field name, file name and the content
-// type inferred from the file extension, then appends the reader's content.
+// AddFileReaderGzip creates a new multipart section with a file content
+// compressed by gzip on the fly. It inserts a header using the given field
+// name, file name and the content type inferred from the file extension,
+// together with the header "Content-Encoding: gzip", then appends
+// the compressed reader's content.
+//
+// The size of the compressed content is not known in advance. If you know
+// it, for example from compressing the same content earlier, pass it
+// as compressedSize to allow computing the total size of the message.
+// Otherwise pass a negative number and the size will be reported unknown.
 //
 // If the reader passed in is a ReaderCloser, it will be owned and eventually
-// freed by the Composer. Do not forget to close the composer, once you do
-// not need it, or defer the closure to perform it automatically in case of
-// a failure. However, do not close the source file. The reader taking part
-// in the request body creation would fail.
-func (c *Composer) AddFileReader(fieldName, fileName string, reader io.Reader) {
-	contentType := mime.TypeByExtension(filepath.Ext(fileName))
-	if contentType == "" {
-		contentType = "application/octet-stream"
+// freed by the Composer, like with AddFileReader.
+func (c *Composer) AddFileReaderGzip(fieldName, fileName string, reader io.Reader, compressedSize int64) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderGzip", ErrNilReader))
+		return
 	}
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "%s--%s\r\nContent-Disposition: form-data; name=\"%s\"; filename=\"%s\"\r\nContent-Type: %s\r\n\r\n",
-		c.delimiter(), c.boundary, escapeQuotes(fieldName), escapeQuotes(fileName), contentType)
-	c.readers = append(c.readers, bytes.NewReader(buf.Bytes()), reader)
-}
-
-// DetachReader finishes the multipart message by adding the trailing
-// boundary end line to the output and moves the closable readers to be
-// closed with the returned compound reader.
-func (c *Composer) DetachReader() io.ReadCloser {
-	c.appendLastBoundary()
-	return c.detachReader()
+	if c.rejectSealed(c.CloseReaders, reader) {
+		return
+	}
+	c.useName(fieldName)
+	header := c.CreateFilePart(fieldName, fileName)
+	header.Set("Content-Encoding", "gzip")
+	compressed := compress(reader)
+	if compressedSize >= 0 {
+		compressed = withSize(compressed, compressedSize)
+	}
+	c.appendPart(header, compressed)
 }
 
-// DetachReaderWithSize finishes the multipart message by adding the trailing
-// boundary end line to the output and moves the closable readers to be
-// closed with the returned compound reader. It tries computing the total
-// request body size, which will work if size was available for all readers.
+// AddPreEncodedFile creates a new multipart section with a file content,
+// which has already been encoded, for example, by base64. It inserts
+// a header using the given field name, file name and the content type
+// inferred from the file extension, together with the header
+// "Content-Transfer-Encoding" set to the encoding, then appends the reader's
+// content verbatim, without encoding it again.
 //
-// If it fails, the composer instance will not be closed.
-func (c *Composer) DetachReaderWithSize() (io.ReadCloser, int64, error) {
-	c.appendLastBoundary()
-	size, err := c.totalSize()
-	if err != nil {
-		return nil, 0, err
+// If the reader passed in is a ReaderCloser, it will be owned and eventually
+// freed by the Composer, like with AddFileReader.
+func (c *Composer) AddPreEncodedFile(fieldName, fileName, encoding string, reader io.Reader) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddPreEncodedFile", ErrNilReader))
+		return
 	}
-	allReader := c.detachReader()
-	return allReader, size, nil
+	c.useName(fieldName)
+	header := c.CreateFilePart(fieldName, fileName)
+	header.Set("Content-Transfer-Encoding", encoding)
+	c.appendPart(header, reader)
 }
 
-// Clear closes all closable readers added by AddFileReader or AddFile and
-// clears their collection, making the composer ready to start empty again.
-func (c *Composer) Clear() {
-	c.Close()
-	c.readers = nil
+// PrependPart works like AddPart, but it inserts the new multipart section
+// before all other sections added earlier.
+func (c *Composer) PrependPart(header textproto.MIMEHeader, reader io.Reader) {
+	c.prepend(func() { c.AddPart(header, reader) })
 }
 
-// Close closes all closable readers added by AddFileReader or AddFile.
-// If some of them fail, the first error will be returned.
-func (c *Composer) Close() error {
-	if c.CloseReaders {
-		return closeAll(c.readers)
-	}
-	return nil
+// PrependField works like AddField, but it inserts the new multipart section
+// before all other sections added earlier. It is useful for parts, which
+// have to be first in the message, but can be computed only at the end.
+func (c *Composer) PrependField(name, value string) {
+	c.prepend(func() { c.AddField(name, value) })
 }
 
-type composedReader struct {
-	io.Reader
-	readers []io.Reader
+// AddCharsetField inserts the field "_charset_" with the given charset
+// before all other sections, like web browsers do for HTML forms with
+// a hidden field of that name. Servers use it to decode the text fields.
+func (c *Composer) AddCharsetField(charset string) {
+	c.PrependField("_charset_", charset)
 }
 
-func (r composedReader) Close() error {
-	return closeAll(r.readers)
+// PrependFieldReader works like AddFieldReader, but it inserts the new
+// multipart section before all other sections added earlier.
+func (c *Composer) PrependFieldReader(name string, reader io.Reader) {
+	c.prepend(func() { c.AddFieldReader(name, reader) })
 }
 
-func (c *Composer) totalSize() (int64, error) {
-	var size int64
-	for _, reader := range c.readers {
-		if withSize, ok := reader.(sizeio.WithSize); ok {
-			size += withSize.Size()
-		} else {
-			return 0, errors.New("multipart: reader without size encountered")
+// PrependFileReader works like AddFileReader, but it inserts the new
+// multipart section before all other sections added earlier.
+func (c *Composer) PrependFileReader(fieldName, fileName string, reader io.Reader) {
+	c.prepend(func() { c.AddFileReader(fieldName, fileName, reader) })
+}
+
+// Parts returns an iterator over the field names and headers of the parts
+// added so far, which can be used with range-over-func since Go 1.23:
+//
+//     for name, header := range comp.Parts() {
+//       fmt.Println(name, header.Get("Content-Type"))
+//     }
+//
+// The headers are copies, modifying them does not change the parts. Raw
+// parts added by AddRawPart are yielded with an empty name and a nil header.
+func (c *Composer) Parts() func(yield func(name string, header textproto.MIMEHeader) bool) {
+	return func(yield func(name string, header textproto.MIMEHeader) bool) {
+		for _, part := range c.parts {
+			var header textproto.MIMEHeader
+			if !part.raw {
+				header = cloneHeader(part.header)
+			}
+			if !yield(Part{Header: part.header}.Name(), header) {
+				return
+			}
 		}
 	}
-	return size, nil
 }
 
-func (c *Composer) detachReader() io.ReadCloser {
-	var readers []io.Reader
-	if c.CloseReaders {
-		readers = c.readers
-	}
-	allReader := composedReader{io.MultiReader(c.readers...), readers}
-	c.readers = nil
-	return allReader
+// PartInfo describes a part added to the Composer, as returned by PartInfos.
+type PartInfo struct {
+	// Name is the field name from the header Content-Disposition.
+	Name string
+	// FileName is the file name from the header Content-Disposition,
+	// or an empty string for fields.
+	FileName string
+	// ContentType is the value of the header Content-Type, or an empty
+	// string if there is none.
+	ContentType string
+	// Size is the size of the content without the header, or -1 if it is
+	// not available.
+	Size int64
 }
 
-func closeAll(readers []io.Reader) error {
-	var firstErr error
-	for _, reader := range readers {
-		if closer, ok := reader.(io.ReadCloser); ok {
-			err := closer.Close()
-			if err != nil && firstErr == nil {
-				firstErr = err
+// PartInfos returns descriptions of the parts added so far in the order
+// in which they were added. Unlike Parts, it returns a slice, which is
+// convenient for assertions in tests. Raw parts added by AddRawPart are
+// described with empty strings.
+func (c *Composer) PartInfos() []PartInfo {
+	infos := make([]PartInfo, len(c.parts))
+	for i, part := range c.parts {
+		var size int64
+		for _, reader := range part.readers {
+			readerSize, ok := sizeOf(reader)
+			if !ok {
+				size = -1
+				break
 			}
+			size += readerSize
 		}
+		info := Part{Header: part.header}
+		infos[i] = PartInfo{Name: info.Name(), FileName: info.FileName(),
+			ContentType: part.header.Get("Content-Type"), Size: size}
 	}
-	return firstErr
+	return infos
 }
 
-func (c *Composer) appendLastBoundary() {
-	c.readers = append(c.readers,
-		strings.NewReader(fmt.Sprintf("\r\n--%s--\r\n", c.boundary)))
+// SortParts reorders the parts added so far using the less function, before
+// the message is detached. Parts considered equal retain their order. It is
+// useful for servers requiring a specific order of parts, for example,
+// with FieldsFirst.
+func (c *Composer) SortParts(less func(a, b Part) bool) {
+	sort.SliceStable(c.parts, func(i, j int) bool {
+		return less(Part{Header: c.parts[i].header}, Part{Header: c.parts[j].header})
+	})
 }
 
-func (c *Composer) delimiter() string {
-	if len(c.readers) > 0 {
-		return "\r\n"
+// AddFile is a convenience wrapper around AddFileReader. It opens the given
+// file and uses its name, stats and content to create the new part.
+//
+// The opened file wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure.
+func (c *Composer) AddFile(fieldName, filePath string) error {
+	reader, err := sizeio.OpenFile(filePath)
+	if err != nil {
+		return err
 	}
-	return ""
+	count := len(c.parts)
+	c.AddFileReaderOwned(fieldName, filepath.Base(filePath), reader, true)
+	if len(c.parts) > count {
+		c.parts[count].path = filePath
+	}
+	return nil
+}
+
+// AddFileIf works like AddFile, if cond is true. Otherwise it does
+// nothing. It is useful for optional files.
+func (c *Composer) AddFileIf(cond bool, fieldName, filePath string) error {
+	if !cond {
+		return nil
+	}
+	return c.AddFile(fieldName, filePath)
+}
+
+// AddFileWithType works like AddFile, but it sets the content type
+// of the part, unless it is empty. An empty content type means inferring
+// it from the file extension as usual.
+//
+// The opened file wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure.
+func (c *Composer) AddFileWithType(fieldName, filePath, contentType string) error {
+	count := len(c.parts)
+	if err := c.AddFile(fieldName, filePath); err != nil {
+		return err
+	}
+	if len(c.parts) > count && contentType != "" {
+		c.parts[count].header.Set("Content-Type", contentType)
+		c.remeasure(c.parts[count])
+	}
+	return nil
+}
+
+// AddGzippedFile is a convenience wrapper around AddFileReader. It opens
+// the given file compressed by gzip and adds its decompressed content.
+// If the file name is empty, the name of the file is used. The extension
+// ".gz" is removed from the file name, so that the content type is inferred
+// from the original extension. The size of the content is not available.
+//
+// The opened file wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure.
+func (c *Composer) AddGzippedFile(fieldName, fileName, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if fileName == "" {
+		fileName = filepath.Base(filePath)
+	}
+	fileName = strings.TrimSuffix(fileName, ".gz")
+	c.AddFileReaderOwned(fieldName, fileName, &gunzipReader{reader, file}, true)
+	return nil
+}
+
+// AddFileFromResponse works like AddFileReader, but it streams the body
+// of the HTTP response. The content length of the response, if known,
+// is used as the size of the content.
+//
+// The response body wil be owned by the Composer, regardless of CloseReaders.
+func (c *Composer) AddFileFromResponse(fieldName, fileName string, resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileFromResponse", ErrNilReader))
+		return
+	}
+	var reader io.Reader = resp.Body
+	if resp.ContentLength >= 0 {
+		reader = withSize(reader, resp.ContentLength)
+	}
+	c.AddFileReaderOwned(fieldName, fileName, reader, true)
+}
+
+// AddFileLazy works like AddFileReader, but the reader is obtained
+// by calling the open function only when the content of the part starts
+// being read. It avoids holding many files open, for example, for queued
+// requests. If the function fails, reading from the message fails with
+// its error. The size of the content is not available.
+//
+// The opened reader wil be owned by the Composer, regardless of CloseReaders.
+func (c *Composer) AddFileLazy(fieldName, fileName string, open func() (io.ReadCloser, error)) {
+	if open == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileLazy", ErrNilReader))
+		return
+	}
+	c.AddFileReaderOwned(fieldName, fileName, &lazyReader{open: open}, true)
+}
+
+// AddFileReaderDeadline works like AddFileReader, but reading the content
+// of the part fails with an error wrapping os.ErrDeadlineExceeded, once it
+// takes longer than timeout. The time is measured from the first read of
+// the content. A read already in progress is not interrupted.
+//
+// If the reader passed in is a ReaderCloser, it will be owned and eventually
+// closed by the Composer according to CloseReaders.
+func (c *Composer) AddFileReaderDeadline(fieldName, fileName string, reader io.Reader, timeout time.Duration) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderDeadline", ErrNilReader))
+		return
+	}
+	c.AddFileReader(fieldName, fileName, wrap(reader, &deadlineReader{source: reader, timeout: timeout}))
+}
+
+// AddFileReaderMax works like AddFileReader, but reading the content
+// of the part fails with ErrPartTooLong, once the reader produces more
+// than max bytes. It protects against a runaway source of unknown size.
+//
+// If the reader passed in is a ReaderCloser, it will be owned and eventually
+// closed by the Composer according to CloseReaders.
+func (c *Composer) AddFileReaderMax(fieldName, fileName string, reader io.Reader, max int64) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderMax", ErrNilReader))
+		return
+	}
+	c.AddFileReader(fieldName, fileName, wrap(reader, &limitedReader{reader, max, ErrPartTooLong}))
+}
+
+// AddFiles is a convenience wrapper around AddFileReader. It opens the given
+// files and uses their names, stats and contents to create new parts, all
+// with the same field name. It is meant for fields with multiple files,
+// which are not considered duplicates by RejectDuplicateFields.
+//
+// If some of the files cannot be opened, the files opened so far will be
+// closed, no part will be added and the error will be returned.
+//
+// The opened files wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure.
+func (c *Composer) AddFiles(fieldName string, filePaths []string) error {
+	readers := make([]io.Reader, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		reader, err := sizeio.OpenFile(filePath)
+		if err != nil {
+			closeAll(readers, false)
+			return err
+		}
+		readers = append(readers, reader)
+	}
+	for i, reader := range readers {
+		if c.addFileReader(fieldName, filepath.Base(filePaths[i]), reader, true) {
+			c.parts[len(c.parts)-1].path = filePaths[i]
+		}
+	}
+	c.markName(fieldName)
+	return nil
+}
+
+// AddFileObject is a convenience wrapper around AddFileReader. It uses
+// the name, stats and content of the opened file to create the new part.
+//
+// The opened file wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure. However,
+// do not close the source file. The reader taking part in the request body creation would fail.
+func (c *Composer) AddFileObject(fieldName string, file *os.File) error {
+	return c.AddFileObjectNamed(fieldName, "", file)
+}
+
+// AddFileObjectNamed is a convenience wrapper around AddFileReader. It uses
+// the given file name and the stats and content of the opened file to create
+// the new part. If the file name is empty, the name of the file is used,
+// like AddFileObject does. It is useful for temporary files, which have
+// randomly generated names.
+//
+// The opened file wil be owned by the Composer, regardless of CloseReaders.
+// Do not forget to close the composer, once you do not need it, or defer
+// the closure to perform it automatically in case of a failure. However,
+// do not close the source file. The reader taking part in the request body creation would fail.
+func (c *Composer) AddFileObjectNamed(fieldName, fileName string, file *os.File) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileName == "" {
+		fileName = stat.Name()
+	}
+	count := len(c.parts)
+	c.AddFileReaderOwned(fieldName, fileName, sizeio.SizeReadCloser(file, stat.Size()), true)
+	if len(c.parts) > count && c.SniffContentType &&
+		c.extensionContentType(fileName) == "" {
+		if contentType, ok := sniffContentType(file); ok && contentType != "application/octet-stream" {
+			c.parts[count].header.Set("Content-Type", contentType)
+			c.remeasure(c.parts[count])
+		}
+	}
+	return nil
+}
+
+// sniffContentType detects the content type from the first 512 bytes
+// of the file from the current position, which is not changed.
+func sniffContentType(file *os.File) (string, bool) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", false
+	}
+	buf := make([]byte, 512)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "", false
+	}
+	return http.DetectContentType(buf[:n]), true
+}
+
+// AddFileReader creates a new multipart section with a file content.
+// It inserts a header using the given field name, file name and the content
+// type inferred from the file extension, then appends the reader's content.
+//
+// If the reader passed in is a ReaderCloser, it will be owned and eventually
+// freed by the Composer. Do not forget to close the composer, once you do
+// not need it, or defer the closure to perform it automatically in case of
+// a failure. However, do not close the source file. The reader taking part
+// in the request body creation would fail.
+func (c *Composer) AddFileReader(fieldName, fileName string, reader io.Reader) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReader", ErrNilReader))
+		return
+	}
+	c.useName(fieldName)
+	c.addFileReader(fieldName, fileName, reader, c.CloseReaders)
+}
+
+// AppendToLastPart appends the content of the reader to the content of
+// the part added last, without starting a new part. It is useful for content
+// discovered incrementally. If no part has been added yet, an error will be
+// recorded and returned by Err. The reader will be closed together with
+// the other readers of the part, if the part is owned by the Composer.
+func (c *Composer) AppendToLastPart(reader io.Reader) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AppendToLastPart", ErrNilReader))
+		return
+	}
+	if c.sealed {
+		c.fail(fmt.Errorf("%w: content not appended", ErrSealed))
+		if len(c.parts) > 0 && c.parts[len(c.parts)-1].owned {
+			closeAll([]io.Reader{reader}, false)
+		}
+		return
+	}
+	if len(c.parts) == 0 {
+		c.fail(ErrNoPart)
+		return
+	}
+	last := c.parts[len(c.parts)-1]
+	last.readers = append(last.readers, reader)
+}
+
+// AddFileReaderPadded works like AddFileReader, but it pads the content
+// to a multiple of blockSize bytes according to PKCS #7: it appends
+// N bytes with the value N, where N is between 1 and blockSize. The block
+// size must be between 1 and 255 and the reader has to provide its size,
+// otherwise an error will be recorded and returned by Err. The padding is
+// included in the size computed by Size.
+func (c *Composer) AddFileReaderPadded(fieldName, fileName string, reader io.Reader, blockSize int) {
+	if blockSize < 1 || blockSize > 255 {
+		c.fail(ErrInvalidBlockSize)
+		return
+	}
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderPadded", ErrNilReader))
+		return
+	}
+	size, ok := sizeOf(reader)
+	if !ok {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderPadded", ErrReaderWithoutSize))
+		return
+	}
+	count := blockSize - int(size%int64(blockSize))
+	c.AddFileReader(fieldName, fileName, reader)
+	c.AppendToLastPart(bytes.NewReader(bytes.Repeat([]byte{byte(count)}, count)))
+}
+
+// FilePart describes a file for AddFileGroup and AddFileReaderSharedType
+// by its name and content.
+type FilePart struct {
+	Name   string
+	Reader io.Reader
+}
+
+// fileReaders returns the readers of the files.
+func fileReaders(files []FilePart) []io.Reader {
+	readers := make([]io.Reader, len(files))
+	for i, file := range files {
+		readers[i] = file.Reader
+	}
+	return readers
+}
+
+// AddFileReaderSharedType works like calling AddFileReader for every file
+// with the same field name, but it sets the same content type to all parts,
+// instead of inferring it from every file name. The content type is rendered
+// only once and the value is shared by all parts, which saves formatting
+// for large batches of files of the same type.
+//
+// If the readers passed in are ReaderClosers, they will be owned and
+// eventually closed by the Composer according to CloseReaders.
+func (c *Composer) AddFileReaderSharedType(fieldName, contentType string, files []FilePart) {
+	for _, file := range files {
+		if file.Reader == nil {
+			c.fail(fmt.Errorf("%w passed to AddFileReaderSharedType", ErrNilReader))
+			return
+		}
+	}
+	if c.rejectSealed(c.CloseReaders, fileReaders(files)...) {
+		return
+	}
+	c.useName(fieldName)
+	prefix := c.dispositionType() + c.dispositionParam("name", fieldName)
+	contentTypes := []string{contentType}
+	for _, file := range files {
+		head := textproto.MIMEHeader{
+			"Content-Disposition": {prefix + c.dispositionParam("filename", file.Name)},
+			"Content-Type":        contentTypes,
+		}
+		c.appendPart(head, file.Reader)
+	}
+}
+
+// AddFileGroup creates a single multipart section for the field with
+// the content type multipart/mixed, which contains the files as nested
+// sections with the disposition type "file", as described in RFC 2388
+// section 4.2. It is the original way to send multiple files for one field,
+// which some servers still expect. The nested sections are created with
+// the same configuration as the sections added by AddFileReader.
+//
+// The readers will be owned by the Composer according to CloseReaders.
+func (c *Composer) AddFileGroup(fieldName string, files []FilePart) {
+	for _, file := range files {
+		if file.Reader == nil {
+			c.fail(fmt.Errorf("%w passed to AddFileGroup", ErrNilReader))
+			return
+		}
+	}
+	if c.rejectSealed(c.CloseReaders, fileReaders(files)...) {
+		return
+	}
+	// the nested message inherits the configuration of the headers,
+	// but it has to be complete and does not check fields
+	group := NewFrom(c)
+	group.required = nil
+	group.HeaderFunc = nil
+	group.MaxSize = 0
+	group.NoClosingDelimiter = false
+	group.TrailingSeparator = ""
+	group.Strict = false
+	for _, file := range files {
+		header := group.CreatePartWithType("file", map[string]string{"filename": file.Name})
+		header.Set("Content-Type", group.fileContentType(file.Name))
+		group.AddPart(header, file.Reader)
+	}
+	header, reader := group.AsPart(fieldName)
+	header.Set("Content-Type", "multipart/mixed"+
+		strings.TrimPrefix(group.FormDataContentType(), "multipart/form-data"))
+	c.AddPart(header, reader)
+}
+
+// AddFileReaderOwned works like AddFileReader, but the own argument decides
+// if the reader will be closed by Close or by the detached reader, instead of
+// CloseReaders. It allows mixing files owned by the Composer with readers
+// shared with other code.
+func (c *Composer) AddFileReaderOwned(fieldName, fileName string, reader io.Reader, own bool) {
+	if reader == nil {
+		c.fail(fmt.Errorf("%w passed to AddFileReaderOwned", ErrNilReader))
+		return
+	}
+	c.useName(fieldName)
+	c.addFileReader(fieldName, fileName, reader, own)
+}
+
+func (c *Composer) addFileReader(fieldName, fileName string, reader io.Reader, own bool) bool {
+	return c.insertPart(&part{header: c.CreateFilePart(fieldName, fileName),
+		readers: []io.Reader{reader}, owned: own})
+}
+
+// Require registers names of fields, which have to be added before
+// the message is detached. Missing fields are reported by Validate
+// and DetachReaderWithSize. The required names are retained by Clear.
+func (c *Composer) Require(names ...string) {
+	c.required = append(c.required, names...)
+}
+
+// checkRequired fails if some of the fields registered by Require
+// have not been added.
+func (c *Composer) checkRequired() error {
+	for _, name := range c.required {
+		if !c.names[name] {
+			return fmt.Errorf("%w %q", ErrMissingField, name)
+		}
+	}
+	return nil
+}
+
+// Validate checks the composed message for errors according to RFC 2046
+// before it is detached. It checks that the boundary is valid, that fields
+// registered by Require were added, that every part except for raw parts
+// has the header Content-Disposition, that no header contains line breaks
+// and that the content of parts buffered in memory does not contain
+// the boundary delimiter. Content of other readers cannot be checked
+// without consuming it.
+func (c *Composer) Validate() error {
+	if err := validateBoundary(c.boundary); err != nil {
+		return err
+	}
+	if err := c.checkRequired(); err != nil {
+		return err
+	}
+	delimiter := []byte(c.delimiterPrefix() + c.boundary)
+	for i, part := range c.parts {
+		if !part.raw {
+			if part.header.Get("Content-Disposition") == "" {
+				return fmt.Errorf("%w %d: missing Content-Disposition", ErrInvalidPart, i)
+			}
+			for key, values := range part.header {
+				if strings.ContainsAny(key, "\r\n") {
+					return fmt.Errorf("%w %d: line break in header name", ErrInvalidPart, i)
+				}
+				for _, value := range values {
+					if strings.ContainsAny(value, "\r\n") {
+						return fmt.Errorf("%w %d: line break in header %s", ErrInvalidPart, i, key)
+					}
+				}
+			}
+		}
+		for _, reader := range part.readers {
+			if buffered, ok := reader.(bufferedReader); ok {
+				content := make([]byte, buffered.Size())
+				if _, err := buffered.ReadAt(content, 0); err != nil && err != io.EOF {
+					return err
+				}
+				if bytes.Contains(content, delimiter) {
+					return fmt.Errorf("%w %d: boundary delimiter in content", ErrInvalidPart, i)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bufferedReader is implemented by readers with the content buffered
+// in memory, like bytes.Reader and strings.Reader.
+type bufferedReader interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// DetachReader finishes the multipart message by adding the trailing
+// boundary end line to the output and moves the closable readers to be
+// closed with the returned compound reader.
+func (c *Composer) DetachReader() io.ReadCloser {
+	return c.detachReader()
+}
+
+// DetachReaderWithSize finishes the multipart message by adding the trailing
+// boundary end line to the output and moves the closable readers to be
+// closed with the returned compound reader. It tries computing the total
+// request body size, which will work if size was available for all readers,
+// either by the interface sizeio.WithSize, or by seeking to the end
+// of the reader. It fails too, if some field registered by Require has
+// not been added.
+//
+// If it fails, the composer instance will not be closed.
+func (c *Composer) DetachReaderWithSize() (io.ReadCloser, int64, error) {
+	if err := c.checkRequired(); err != nil {
+		return nil, 0, err
+	}
+	size, err := c.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+	allReader := c.detachReader()
+	return allReader, size, nil
+}
+
+// DetachReaderReplayable works like DetachReaderWithSize, but it also returns
+// a function creating a fresh reader of the same message, as expected
+// by http.Request.GetBody for retries and redirects:
+//
+//     body, getBody, size, err := comp.DetachReaderReplayable()
+//     req.Body, req.GetBody, req.ContentLength = body, getBody, size
+//
+// Files added by AddFile or AddFiles are opened again for every new reader
+// and closed by its Close. Other readers have to implement io.Seeker and are
+// rewound to their initial position for every new reader. They are not closed
+// by the returned readers, so they must not be owned by the Composer, if they
+// implement io.Closer; the caller has to close them, once the request is
+// finished. If some reader cannot be rewound, or if it would have to be
+// closed by the Composer, ErrNotReplayable is returned and the Composer is
+// left intact.
+func (c *Composer) DetachReaderReplayable() (io.ReadCloser, func() (io.ReadCloser, error), int64, error) {
+	if err := c.checkRequired(); err != nil {
+		return nil, nil, 0, err
+	}
+	size, err := c.Size()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sources := make([][]func() (io.Reader, bool, error), len(c.parts))
+	for i, part := range c.parts {
+		for j, reader := range part.readers {
+			if j == 0 && part.path != "" {
+				sources[i] = append(sources[i], reopenFile(part.path, reader))
+			} else if _, ok := reader.(io.Closer); ok && part.owned {
+				return nil, nil, 0, fmt.Errorf("%w: reader %d of part %d is owned", ErrNotReplayable, j, i)
+			} else if seeker, ok := reader.(io.ReadSeeker); ok {
+				source, err := rewindReader(seeker)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+				sources[i] = append(sources[i], source)
+			} else {
+				return nil, nil, 0, fmt.Errorf("%w: reader %d of part %d", ErrNotReplayable, j, i)
+			}
+		}
+	}
+	heads := make([][]byte, len(c.parts))
+	for i, part := range c.parts {
+		heads[i] = c.renderHead(i, part)
+	}
+	closing, maxSize, joinErrors := c.closingLine(), c.MaxSize, c.JoinCloseErrors
+	getBody := func() (io.ReadCloser, error) {
+		readers := make([]io.Reader, 0, 2*len(heads)+1)
+		var opened []io.Reader
+		for i, head := range heads {
+			readers = append(readers, bytes.NewReader(head))
+			for _, source := range sources[i] {
+				reader, owned, err := source()
+				if err != nil {
+					closeAll(opened, false)
+					return nil, err
+				}
+				if owned {
+					opened = append(opened, reader)
+				}
+				readers = append(readers, reader)
+			}
+		}
+		readers = append(readers, bytes.NewReader(closing))
+		var reader io.Reader = io.MultiReader(readers...)
+		if maxSize > 0 {
+			reader = &limitedReader{reader, maxSize, ErrMessageTooLong}
+		}
+		return &composedReader{reader: reader, readers: opened, joinErrors: joinErrors}, nil
+	}
+	c.resetParts()
+	c.sealed = c.sealed || c.Strict
+	body, err := getBody()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return body, getBody, size, nil
+}
+
+// reopenFile returns a source of the content of the file for
+// DetachReaderReplayable, which returns the already opened reader first
+// and opens the file again for the next calls. The readers are owned.
+func reopenFile(path string, reader io.Reader) func() (io.Reader, bool, error) {
+	return func() (io.Reader, bool, error) {
+		if reader != nil {
+			opened := reader
+			reader = nil
+			return opened, true, nil
+		}
+		opened, err := sizeio.OpenFile(path)
+		return opened, true, err
+	}
+}
+
+// rewindReader returns a source of the content of the reader for
+// DetachReaderReplayable, which seeks to the current position of the reader
+// for every call. The reader is not owned.
+func rewindReader(reader io.ReadSeeker) (func() (io.Reader, bool, error), error) {
+	offset, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.Reader, bool, error) {
+		_, err := reader.Seek(offset, io.SeekStart)
+		return reader, false, err
+	}, nil
+}
+
+// DetachReaderWithKnownSize finishes the multipart message by adding
+// the trailing boundary end line to the output and moves the closable readers
+// to be closed with the returned compound reader. It returns the size of all
+// boundary lines, headers and the content of readers with the size available,
+// and the count of parts with a content of an unknown size. If the count is
+// zero, the size is the total size of the message, which can be used for
+// Content-Length. Otherwise the message has to be sent chunked.
+func (c *Composer) DetachReaderWithKnownSize() (io.ReadCloser, int64, int) {
+	c.resolveTotalSizeFields()
+	size := int64(len(c.closingLine()))
+	unknown := 0
+	for i, part := range c.parts {
+		size += int64(len(c.renderHead(i, part)))
+		sized := true
+		for _, reader := range part.readers {
+			if readerSize, ok := sizeOf(reader); ok {
+				size += readerSize
+			} else {
+				sized = false
+			}
+		}
+		if !sized {
+			unknown++
+		}
+	}
+	return c.detachReader(), size, unknown
+}
+
+// DetachReaderWithExplicitSize finishes the multipart message by adding
+// the trailing boundary end line to the output and moves the closable readers
+// to be closed with the returned compound reader. The returned reader
+// provides the given size by the method Size, as declared by the interface
+// sizeio.WithSize.
+//
+// WARNING: The size is trusted without any check. Use it only if it is known
+// from an authoritative source. If it does not match the real size of the
+// message, including the part headers and boundaries, the request will fail
+// or hang. Prefer DetachReaderWithSize, if all readers provide their size.
+func (c *Composer) DetachReaderWithExplicitSize(size int64) io.ReadCloser {
+	return &sizedReader{c.detachReader(), size}
+}
+
+// DetachReaderLimited finishes the multipart message by adding the trailing
+// boundary end line to the output and moves the closable readers to be
+// closed with the returned compound reader. Reading from the returned reader
+// fails, once the message turns out to be longer than max bytes. It is
+// useful for streaming readers, which size is not known in advance.
+func (c *Composer) DetachReaderLimited(max int64) io.ReadCloser {
+	reader := c.detachReader()
+	return &wrappedReader{reader, &limitedReader{reader, max, ErrMessageTooLong}}
+}
+
+// DetachReaderControlled finishes the multipart message by adding
+// the trailing boundary end line to the output and moves the closable readers
+// to be closed with the returned compound reader. Reading from the returned
+// reader is throttled to bytesPerSecond, if it is positive, and fails once
+// the context is cancelled or its deadline exceeded. Closing the returned
+// reader closes the readers of the parts as usual.
+func (c *Composer) DetachReaderControlled(ctx context.Context, bytesPerSecond int64) io.ReadCloser {
+	reader := c.detachReader()
+	return &wrappedReader{reader, &controlledReader{source: reader, ctx: ctx, rate: bytesPerSecond}}
+}
+
+// DetachReaderSlow finishes the multipart message by adding the trailing
+// boundary end line to the output and moves the closable readers to be
+// closed with the returned compound reader. Every read from the returned
+// reader is delayed by delayPerRead. It is meant for testing the handling
+// of slow clients by servers.
+func (c *Composer) DetachReaderSlow(delayPerRead time.Duration) io.ReadCloser {
+	reader := c.detachReader()
+	return &wrappedReader{reader, &slowReader{reader, delayPerRead}}
+}
+
+// DetachReaderWith works like DetachReader, but the returned reader reads
+// the readers of the message, the boundary lines with part headers and
+// the part contents, sequenced by seq instead of io.MultiReader. It allows
+// custom scheduling of the reads. The readers are passed in the order
+// of the message, the sequencer has to produce their content in this order
+// to produce a valid message. The owned readers are closed by the returned
+// reader as usual. If seq is nil, io.MultiReader is used.
+func (c *Composer) DetachReaderWith(seq func([]io.Reader) io.Reader) io.ReadCloser {
+	if seq == nil {
+		return c.detachReader()
+	}
+	return c.detachReaderWith(func(readers ...io.Reader) io.Reader {
+		return seq(readers)
+	})
+}
+
+// DetachReaderTee finishes the multipart message by adding the trailing
+// boundary end line to the output and moves the closable readers to be
+// closed with the returned compound reader. Everything read from
+// the returned reader is written to w too, for example, to archive
+// the content of the request body. Writing errors are returned by Read.
+func (c *Composer) DetachReaderTee(w io.Writer) io.ReadCloser {
+	reader := c.detachReader()
+	return &wrappedReader{reader, io.TeeReader(reader, w)}
+}
+
+// DetachReaderWithCRC32C finishes the multipart message by adding
+// the trailing boundary end line to the output and moves the closable readers
+// to be closed with the returned compound reader. The checksum CRC32C
+// (Castagnoli) of the message is computed while it is read. The returned
+// function returns the checksum of the content read so far; it is complete
+// once the returned reader reaches the end.
+func (c *Composer) DetachReaderWithCRC32C() (io.ReadCloser, func() uint32) {
+	hash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	return c.DetachReaderTee(hash), hash.Sum32
+}
+
+// AsPart finishes the multipart message and returns it as a header
+// and a reader, which can be passed to AddPart of another Composer to nest
+// the message. The header contains the field name and the content type
+// with the boundary of this Composer. If the size of the message is
+// available, the returned reader provides it too.
+func (c *Composer) AsPart(fieldName string) (textproto.MIMEHeader, io.Reader) {
+	header := c.CreateFieldPart(fieldName)
+	header.Set("Content-Type", c.FormDataContentType())
+	if size, err := c.Size(); err == nil {
+		return header, &sizedReader{c.detachReader(), size}
+	}
+	return header, c.detachReader()
+}
+
+// Size computes the total size of the multipart message including
+// the trailing boundary end line, which will be added by the DetachReader
+// methods. It will work if size was available for all readers, either
+// by the method Len of in-memory readers like bytes.Buffer, by the interface
+// sizeio.WithSize, or by seeking to the end of the reader.
+//
+// The sizes of part headers are measured when the parts are added and
+// summed up continuously, so that the headers are not rendered again.
+// Headers must not be modified after adding them. The sizes of readers
+// and delimiter lines are computed at the time of the call, so that
+// readers may grow after adding them. If HeaderFunc is set, the headers
+// of all parts are rendered again, because the function may modify them.
+func (c *Composer) Size() (int64, error) {
+	c.resolveTotalSizeFields()
+	if c.HeaderFunc == nil {
+		size := c.headerSize + int64(len(c.closingLine()))
+		if len(c.parts) > 0 {
+			size += int64(len(c.parts)) * int64(len(c.BoundaryLine()))
+			size += int64(len(c.parts)-1) * 2
+		}
+		for _, part := range c.parts {
+			for _, reader := range part.readers {
+				readerSize, ok := sizeOf(reader)
+				if !ok {
+					return 0, fmt.Errorf("%w encountered", ErrReaderWithoutSize)
+				}
+				size += readerSize
+			}
+		}
+		return size, nil
+	}
+	var size int64
+	for i := range c.parts {
+		partSize, ok := c.PartSize(i)
+		if !ok {
+			return 0, fmt.Errorf("%w encountered", ErrReaderWithoutSize)
+		}
+		size += partSize
+	}
+	return size + int64(len(c.closingLine())), nil
+}
+
+// SizeWithoutClosing computes the size of the parts added so far, like Size,
+// but without the trailing boundary end line. It is useful for computing
+// byte ranges of resumable uploads, which send the end line only in the last
+// chunk.
+func (c *Composer) SizeWithoutClosing() (int64, error) {
+	size, err := c.Size()
+	if err != nil {
+		return 0, err
+	}
+	return size - int64(len(c.closingLine())), nil
+}
+
+// ChunkedSizeEstimate computes the size of the message sent with the chunked
+// transfer encoding in chunks of chunkSize bytes, including the chunk size
+// lines, the line breaks after the chunks and the terminating empty chunk.
+// It is useful for bandwidth accounting. The size of all readers has to be
+// available, like for Size. The chunk size has to be positive.
+func (c *Composer) ChunkedSizeEstimate(chunkSize int) (int64, error) {
+	if chunkSize < 1 {
+		return 0, ErrInvalidChunkSize
+	}
+	size, err := c.Size()
+	if err != nil {
+		return 0, err
+	}
+	chunk := int64(chunkSize)
+	full, rest := size/chunk, size%chunk
+	// every chunk is "<hex size>\r\n<data>\r\n", ended by "0\r\n\r\n"
+	total := size + full*int64(len(strconv.FormatInt(chunk, 16))+4) + 5
+	if rest > 0 {
+		total += int64(len(strconv.FormatInt(rest, 16)) + 4)
+	}
+	return total, nil
+}
+
+// PartSize computes the size of the part at the given index, as it will
+// be written to the multipart message, including the boundary delimiter
+// line and the part header. The sizes of all parts and the length
+// of the ClosingBoundaryLine with TrailingSeparator add up to the total Size.
+// The size of the part added last is the count of bytes, by which adding
+// the part increased Size. Parts added by AddField always have their size
+// available, which helps deciding about optional fields in forms with
+// a size budget. The boolean result is false if the size is not available
+// for the part content, or if there is no part at the index.
+func (c *Composer) PartSize(index int) (int64, bool) {
+	if index < 0 || index >= len(c.parts) {
+		return 0, false
+	}
+	part := c.parts[index]
+	size := int64(len(c.renderHead(index, part)))
+	for _, reader := range part.readers {
+		readerSize, ok := sizeOf(reader)
+		if !ok {
+			return 0, false
+		}
+		size += readerSize
+	}
+	return size, true
+}
+
+// WriteTo finishes the multipart message by adding the trailing boundary
+// end line and writes the whole message to w. The closable readers are
+// closed afterwards, even in case of failure. It implements io.WriterTo.
+//
+// If CopyBufferSize is positive, a buffer of that size is used to copy
+// the content, unless w implements io.ReaderFrom.
+func (c *Composer) WriteTo(w io.Writer) (int64, error) {
+	reader := c.DetachReader()
+	var size int64
+	var err error
+	if c.CopyBufferSize > 0 {
+		size, err = io.CopyBuffer(w, reader, make([]byte, c.CopyBufferSize))
+	} else {
+		size, err = io.Copy(w, reader)
+	}
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// WriteEML writes the whole message to the file at path, preceded by
+// the header with MIME-Version and Content-Type, as returned by
+// FormDataContentType. The file can be opened by e-mail clients and other
+// MIME tools, which makes it useful for archiving and debugging. The closable
+// readers are closed afterwards, as with WriteTo. If the file cannot be
+// created, the composer is left intact.
+func (c *Composer) WriteEML(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "MIME-Version: 1.0\r\nContent-Type: %s\r\n\r\n", c.FormDataContentType())
+	if err == nil {
+		_, err = c.WriteTo(file)
+	} else {
+		c.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteParts writes every part to the writer returned by fn for the index
+// of the part. The bytes written for a part include the boundary delimiter
+// line and the header, as counted by PartSize. The trailing boundary end
+// line is not written. It is useful for inspecting the parts separately,
+// for example, in tests. The owned readers are closed afterwards, even
+// in case of failure, and the composer is left empty.
+func (c *Composer) WriteParts(fn func(index int) io.Writer) error {
+	c.resolveTotalSizeFields()
+	var err error
+	for i, part := range c.parts {
+		w := fn(i)
+		if _, err = w.Write(c.renderHead(i, part)); err != nil {
+			break
+		}
+		for _, reader := range part.readers {
+			if c.CopyBufferSize > 0 {
+				_, err = io.CopyBuffer(w, reader, make([]byte, c.CopyBufferSize))
+			} else {
+				_, err = io.Copy(w, reader)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := closeAll(c.ownedReaders(), c.JoinCloseErrors); err == nil {
+		err = closeErr
+	}
+	c.resetParts()
+	c.sealed = c.sealed || c.Strict
+	return err
+}
+
+// Clear closes all closable readers added by AddFileReader or AddFile and
+// clears their collection, making the composer ready to start empty again.
+// It resets the error returned by Err too.
+func (c *Composer) Clear() {
+	c.Close()
+	c.resetParts()
+	c.err = nil
+}
+
+// DebugReaderCount returns the count of readers, which the reader returned
+// by the DetachReader methods would consist of: one reader for the boundary
+// line and the header of every part, the readers with the content of every
+// part and the reader of the trailing boundary end line. It is meant for
+// diagnostics.
+func (c *Composer) DebugReaderCount() int {
+	return len(c.parts) + len(c.contentReaders()) + 1
+}
+
+// RedactField registers names of fields, which values are replaced with "***"
+// in the output of DebugString, so that passwords or tokens do not appear
+// in logs. The message itself is not affected. The redacted names are
+// retained by Clear.
+func (c *Composer) RedactField(name string) {
+	c.redacted = append(c.redacted, name)
+}
+
+// DebugString returns a human-readable summary of the message for logging,
+// without consuming the readers. It contains the count of parts, the total
+// size and the field name, the file name and the size of every part. Values
+// of fields are included, if they are in memory, up to 64 bytes. Values
+// of fields registered by RedactField are replaced with "***":
+//
+//     # multipart body, 3 parts, unknown size
+//     0: comment = "text", 118 bytes
+//     1: password = ***, 123 bytes
+//     2: file (test.txt), unknown size
+func (c *Composer) DebugString() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# multipart body, %d parts, ", len(c.parts))
+	if size, err := c.Size(); err == nil {
+		fmt.Fprintf(&buf, "%d bytes\n", size)
+	} else {
+		buf.WriteString("unknown size\n")
+	}
+	for i, part := range c.parts {
+		fmt.Fprintf(&buf, "%d: ", i)
+		if part.raw {
+			buf.WriteString("(raw)")
+		} else {
+			info := Part{Header: part.header}
+			buf.WriteString(info.Name())
+			if fileName := info.FileName(); fileName != "" {
+				fmt.Fprintf(&buf, " (%s)", fileName)
+			} else if c.isRedacted(info.Name()) {
+				buf.WriteString(" = ***")
+			} else if value, ok := peekValue(part.readers); ok {
+				fmt.Fprintf(&buf, " = %q", value)
+			}
+		}
+		if size, ok := c.PartSize(i); ok {
+			fmt.Fprintf(&buf, ", %d bytes\n", size)
+		} else {
+			buf.WriteString(", unknown size\n")
+		}
+	}
+	return buf.String()
+}
+
+// isRedacted checks if the field name was registered by RedactField.
+func (c *Composer) isRedacted(name string) bool {
+	for _, redacted := range c.redacted {
+		if redacted == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxPeekLength is the maximum length of a field value in DebugString.
+const maxPeekLength = 64
+
+// peekValue returns the unread content of a single in-memory reader, like
+// strings.Reader, without consuming it. Longer content is shortened
+// to maxPeekLength bytes followed by "...".
+func peekValue(readers []io.Reader) (string, bool) {
+	if len(readers) != 1 {
+		return "", false
+	}
+	reader, ok := readers[0].(interface {
+		io.ReaderAt
+		Len() int
+		Size() int64
+	})
+	if !ok {
+		return "", false
+	}
+	length := int64(reader.Len())
+	offset := reader.Size() - length
+	suffix := ""
+	if length > maxPeekLength {
+		length, suffix = maxPeekLength, "..."
+	}
+	value := make([]byte, length)
+	if _, err := reader.ReadAt(value, offset); err != nil && err != io.EOF {
+		return "", false
+	}
+	return string(value) + suffix, true
+}
+
+// IsEmpty reports whether no part has been added yet. The message of an empty
+// composer consists only of the ClosingBoundaryLine "\r\n--<boundary>--\r\n".
+// The leading line break is a preamble, which is ignored by parsers, and
+// the message is parsed as a message without parts. However, RFC 2046
+// requires at least one part and some servers may reject it.
+func (c *Composer) IsEmpty() bool {
+	return len(c.parts) == 0
+}
+
+// HasClosableReaders reports whether any of the added readers implements
+// io.Closer. If there is none, deferring a call to Close is not necessary.
+func (c *Composer) HasClosableReaders() bool {
+	for _, reader := range c.contentReaders() {
+		if _, ok := reader.(io.Closer); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ClosableReaders returns the added readers, which implement io.Closer,
+// regardless of being owned by the Composer. It allows managing their
+// lifetime externally, for example, after setting CloseReaders to false
+// or disowning them by AddFileReaderOwned.
+func (c *Composer) ClosableReaders() []io.Closer {
+	var closers []io.Closer
+	for _, reader := range c.contentReaders() {
+		if closer, ok := reader.(io.Closer); ok {
+			closers = append(closers, closer)
+		}
+	}
+	return closers
+}
+
+// Close closes all closable readers added by AddFileReader or AddFile, which
+// are owned by the Composer. If some of them fail, the first error will be
+// returned.
+//
+// The parts are retained, but the Composer gives up the ownership of their
+// readers, so that calling Close again does nothing. Use Clear to release
+// the parts too. Readers detached by one of the DetachReader methods are not
+// closed by Close, but by the returned compound reader.
+func (c *Composer) Close() error {
+	var closable []io.Reader
+	for _, part := range c.parts {
+		if part.owned {
+			for _, reader := range part.readers {
+				if _, ok := reader.(io.Closer); ok {
+					closable = append(closable, reader)
+				}
+			}
+			part.owned = false
+		}
+	}
+	return closeAll(closable, c.JoinCloseErrors)
+}
+
+// ReadCounter is implemented by the readers returned by the DetachReader
+// methods. It allows polling the progress of the request body consumption.
+//
+//     reqBody := comp.DetachReader()
+//     sent := reqBody.(composer.ReadCounter).BytesRead()
+type ReadCounter interface {
+	// BytesRead returns the count of bytes read so far. It can be called
+	// from a different goroutine than the one reading.
+	BytesRead() int64
+}
+
+type composedReader struct {
+	read       int64 // accessed atomically, first to be aligned on 32-bit systems
+	reader     io.Reader
+	readers    []io.Reader
+	checkers   []*sizeChecker
+	joinErrors bool
+}
+
+func (r *composedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+// BytesRead implements ReadCounter.
+func (r *composedReader) BytesRead() int64 {
+	return atomic.LoadInt64(&r.read)
+}
+
+// Close closes the readers owned by the compound reader. If VerifySizes was
+// set, it checks the sizes of the readers afterwards. Calling it again does
+// nothing.
+func (r *composedReader) Close() error {
+	readers, checkers := r.readers, r.checkers
+	r.readers, r.checkers = nil, nil
+	if err := closeAll(readers, r.joinErrors); err != nil {
+		return err
+	}
+	for _, checker := range checkers {
+		if err := checker.verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sizedReader struct {
+	*composedReader
+	size int64
+}
+
+// Size implements sizeio.WithSize.
+func (r *sizedReader) Size() int64 {
+	return r.size
+}
+
+// lengther is implemented by in-memory readers like bytes.Buffer,
+// bytes.Reader and strings.Reader, returning the count of unread bytes.
+type lengther interface {
+	Len() int
+}
+
+// sizeOf returns the size of the reader content, if the reader provides it
+// by the method Len, by implementing sizeio.WithSize, or if it is a Seeker.
+// The size returned by Len and the size of a Seeker is the count of bytes
+// from the current position to the end.
+func sizeOf(reader io.Reader) (int64, bool) {
+	switch sized := reader.(type) {
+	case lengther:
+		return int64(sized.Len()), true
+	case sizeio.WithSize:
+		return sized.Size(), true
+	case io.Seeker:
+		current, err := sized.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		end, err := sized.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := sized.Seek(current, io.SeekStart); err != nil {
+			return 0, false
+		}
+		return end - current, true
+	}
+	return 0, false
+}
+
+func (c *Composer) detachReader() *composedReader {
+	return c.detachReaderWith(io.MultiReader)
+}
+
+// detachReaderWith works like detachReader, but it sequences the readers
+// of the message by seq.
+func (c *Composer) detachReaderWith(seq func(...io.Reader) io.Reader) *composedReader {
+	c.resolveTotalSizeFields()
+	readers := make([]io.Reader, 0, 2*len(c.parts)+1)
+	var checkers []*sizeChecker
+	for i, part := range c.parts {
+		readers = append(readers, bytes.NewReader(c.renderHead(i, part)))
+		for _, reader := range part.readers {
+			if _, ok := reader.(sizeio.WithSize); ok && c.VerifySizes {
+				size, _ := sizeOf(reader)
+				checker := &sizeChecker{source: reader, size: size}
+				checkers = append(checkers, checker)
+				reader = checker
+			}
+			readers = append(readers, reader)
+		}
+	}
+	readers = append(readers, bytes.NewReader(c.closingLine()))
+	reader := seq(readers...)
+	if c.MaxSize > 0 {
+		reader = &limitedReader{reader, c.MaxSize, ErrMessageTooLong}
+	}
+	allReader := &composedReader{reader: reader, readers: c.ownedReaders(),
+		checkers: checkers, joinErrors: c.JoinCloseErrors}
+	c.resetParts()
+	c.sealed = c.sealed || c.Strict
+	return allReader
+}
+
+// appendPart adds a new part with the header and the reader, unless
+// the Composer is sealed. It returns false if the part was not added.
+func (c *Composer) appendPart(header textproto.MIMEHeader, reader io.Reader) bool {
+	return c.insertPart(&part{header: canonicalHeader(header), readers: []io.Reader{reader}, owned: c.CloseReaders})
+}
+
+// appendRawPart adds a new raw part, which content includes the rendered
+// header, unless the Composer is sealed. It returns false if the part was
+// not added.
+func (c *Composer) appendRawPart(reader io.Reader) bool {
+	return c.insertPart(&part{readers: []io.Reader{reader}, raw: true, owned: c.CloseReaders})
+}
+
+// insertPart measures the part and appends it to the other ones, unless
+// the Composer is sealed. It returns false if the part was not added.
+func (c *Composer) insertPart(part *part) bool {
+	if c.rejectSealed(part.owned, part.readers...) {
+		return false
+	}
+	c.measure(part)
+	c.parts = append(c.parts, part)
+	return true
+}
+
+// rejectSealed records ErrSealed, if the Composer is sealed, and closes
+// the readers, if they would be owned by the Composer. It returns true
+// if the readers were rejected.
+func (c *Composer) rejectSealed(own bool, readers ...io.Reader) bool {
+	if !c.sealed {
+		return false
+	}
+	c.fail(fmt.Errorf("%w: part not added", ErrSealed))
+	if own {
+		closeAll(readers, false)
+	}
+	return true
+}
+
+// measure computes the size of the part header and adds it to the running
+// total of the header sizes.
+func (c *Composer) measure(part *part) {
+	part.headerSize = 0
+	if !part.raw {
+		var buf bytes.Buffer
+		writeHeader(&buf, part.header, nil)
+		part.headerSize = int64(buf.Len())
+	}
+	c.headerSize += part.headerSize
+}
+
+// remeasure updates the size of the part header after it was changed.
+func (c *Composer) remeasure(part *part) {
+	c.headerSize -= part.headerSize
+	c.measure(part)
+}
+
+// resetParts removes all parts and their names.
+func (c *Composer) resetParts() {
+	c.parts = nil
+	c.names = nil
+	c.headerSize = 0
+	c.totalSizeFields = 0
+}
+
+// prepend moves the part appended by the add function, if it succeeded,
+// to the beginning of the message.
+func (c *Composer) prepend(add func()) {
+	c.insert(0, add)
+}
+
+// insert moves the part appended by the add function, if it succeeded,
+// to the index.
+func (c *Composer) insert(index int, add func()) {
+	count := len(c.parts)
+	add()
+	if len(c.parts) > count {
+		last := c.parts[count]
+		copy(c.parts[index+1:], c.parts[index:count])
+		c.parts[index] = last
+	}
+}
+
+// resolveTotalSizeFields sets the content of the fields added by
+// AddTotalSizeField to the size of the message without these fields.
+func (c *Composer) resolveTotalSizeFields() {
+	if c.totalSizeFields == 0 {
+		return
+	}
+	size := int64(len(c.closingLine()))
+	sized := true
+	index := 0
+	for _, part := range c.parts {
+		if part.totalSize {
+			continue
+		}
+		size += int64(len(c.renderHead(index, part)))
+		index++
+		for _, reader := range part.readers {
+			readerSize, ok := sizeOf(reader)
+			if !ok {
+				sized = false
+			}
+			size += readerSize
+		}
+	}
+	for _, part := range c.parts {
+		if part.totalSize {
+			var reader io.Reader = &errorReader{fmt.Errorf("%w encountered", ErrReaderWithoutSize)}
+			if sized {
+				reader = strings.NewReader(strconv.FormatInt(size, 10))
+			}
+			part.readers = []io.Reader{reader}
+		}
+	}
+}
+
+// dispositionType returns DispositionType or "form-data", if it is empty.
+func (c *Composer) dispositionType() string {
+	if c.DispositionType == "" {
+		return "form-data"
+	}
+	return c.DispositionType
+}
+
+// delimiterPrefix returns the prefix of the boundary on the delimiter lines.
+func (c *Composer) delimiterPrefix() string {
+	if c.NoDelimiterPrefix {
+		return ""
+	}
+	if c.DelimiterPrefix == "" {
+		return "--"
+	}
+	return c.DelimiterPrefix
+}
+
+// closingLine returns the line ending the message preceded
+// by TrailingSeparator, unless NoClosingDelimiter is set.
+func (c *Composer) closingLine() []byte {
+	if c.NoClosingDelimiter {
+		return nil
+	}
+	return append([]byte(c.TrailingSeparator), c.ClosingBoundaryLine()...)
+}
+
+// renderHead renders the boundary delimiter line and the header of the part
+// at the given index. Parts following another part start with a line break.
+// Nothing is rendered for parts streamed by AddFromMultipartReader, which
+// render the delimiters themselves.
+func (c *Composer) renderHead(index int, part *part) []byte {
+	if stream, ok := part.readers[0].(*multipartStream); ok {
+		stream.first = index == 0
+		return nil
+	}
+	var buf bytes.Buffer
+	if index > 0 {
+		buf.WriteString("\r\n")
+	}
+	buf.Write(c.BoundaryLine())
+	if part.raw {
+		return buf.Bytes()
+	}
+	header := part.header
+	if c.HeaderFunc != nil {
+		header = cloneHeader(header)
+		c.HeaderFunc(index, header)
+	}
+	var order []string
+	if c.PreserveHeaderOrder {
+		order = part.order
+	}
+	writeHeader(&buf, header, order)
+	return buf.Bytes()
+}
+
+// writeHeader writes the header fields and the empty line ending the header.
+// Fields with keys in order are written first in that order, the rest is
+// sorted by their keys. Keys are written in the canonical MIME casing, even
+// if the header was constructed manually. A nil header is written as
+// an empty one.
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader, order []string) {
+	keys := make([]string, 0, len(header))
+	ordered := make(map[string]bool, len(order))
+	for _, key := range order {
+		if _, ok := header[key]; ok {
+			keys = append(keys, key)
+			ordered[key] = true
+		}
+	}
+	rest := len(keys)
+	for key := range header {
+		if !ordered[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys[rest:], func(i, j int) bool {
+		return textproto.CanonicalMIMEHeaderKey(keys[rest+i]) <
+			textproto.CanonicalMIMEHeaderKey(keys[rest+j])
+	})
+	for _, key := range keys {
+		name := textproto.CanonicalMIMEHeaderKey(key)
+		for _, val := range header[key] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, val)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+// contentReaders returns the readers with the content of all parts.
+func (c *Composer) contentReaders() []io.Reader {
+	var readers []io.Reader
+	for _, part := range c.parts {
+		readers = append(readers, part.readers...)
+	}
+	return readers
+}
+
+// ownedReaders returns the readers with the content of the parts owned
+// by the Composer.
+func (c *Composer) ownedReaders() []io.Reader {
+	var readers []io.Reader
+	for _, part := range c.parts {
+		if part.owned {
+			readers = append(readers, part.readers...)
+		}
+	}
+	return readers
+}
+
+// CloseErrors contains errors returned by readers failing to close.
+// It is returned if JoinCloseErrors is set.
+type CloseErrors []error
+
+// Error returns messages of all errors separated by line breaks.
+func (e CloseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Is reports whether any of the contained errors matches the target
+// according to errors.Is. It supports errors.Is before Go 1.20, which
+// does not call Unwrap returning a slice.
+func (e CloseErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the contained errors, which matches the target
+// according to errors.As, and sets the target to it. It supports errors.As
+// before Go 1.20, which does not call Unwrap returning a slice.
+func (e CloseErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the contained errors for errors.Is and errors.As since
+// Go 1.20.
+func (e CloseErrors) Unwrap() []error {
+	return e
+}
+
+// closeAll closes all closable readers. It returns either the first error,
+// or all errors in CloseErrors, if joinErrors is set.
+func closeAll(readers []io.Reader, joinErrors bool) error {
+	var errs CloseErrors
+	for _, reader := range readers {
+		if closer, ok := reader.(io.ReadCloser); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if joinErrors {
+		return errs
+	}
+	return errs[0]
+}
+
+func (c *Composer) useName(name string) {
+	if c.RejectDuplicateFields && c.names[name] {
+		c.fail(fmt.Errorf("%w %q", ErrDuplicateField, name))
+	}
+	c.markName(name)
+}
+
+func (c *Composer) markName(name string) {
+	if c.names == nil {
+		c.names = make(map[string]bool)
+	}
+	c.names[name] = true
+}
+
+func (c *Composer) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// fileContentType infers the content type from the file extension.
+func (c *Composer) fileContentType(fileName string) string {
+	contentType := c.extensionContentType(fileName)
+	if contentType == "" {
+		if c.DefaultContentType != "" {
+			return c.DefaultContentType
+		}
+		return "application/octet-stream"
+	}
+	if c.AssumeUTF8Text {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err == nil && strings.HasPrefix(mediaType, "text/") && params["charset"] == "" {
+			contentType += "; charset=utf-8"
+		}
+	}
+	return contentType
+}
+
+// builtinContentTypes maps file extensions of common web types to their
+// content types, so that they do not depend on the operating system.
+var builtinContentTypes = map[string]string{
+	".css":  "text/css; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".gif":  "image/gif",
+	".gz":   "application/gzip",
+	".htm":  "text/html; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".mjs":  "text/javascript; charset=utf-8",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".txt":  "text/plain; charset=utf-8",
+	".wasm": "application/wasm",
+	".webp": "image/webp",
+	".xml":  "text/xml; charset=utf-8",
+	".zip":  "application/zip",
+}
+
+// extensionContentType infers the content type from the file extension,
+// consulting builtinContentTypes first, unless SystemContentTypes is set.
+// It returns an empty string for unknown extensions.
+func (c *Composer) extensionContentType(fileName string) string {
+	ext := filepath.Ext(fileName)
+	if !c.SystemContentTypes {
+		if contentType, ok := builtinContentTypes[strings.ToLower(ext)]; ok {
+			return contentType
+		}
+	}
+	return mime.TypeByExtension(ext)
+}
+
+func validateBoundary(boundary string) error {
+	// rfc2046#section-5.1.1
+	if len(boundary) < 1 {
+		return ErrBoundaryEmpty
+	}
+	if len(boundary) > 70 {
+		return ErrBoundaryTooLong
+	}
+	end := len(boundary) - 1
+	for i, c := range boundary {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+			continue
+		}
+		switch c {
+		case '\'', '(', ')', '+', '_', ',', '-', '.', '/', ':', '=', '?':
+			continue
+		case ' ':
+			if i != end {
+				continue
+			}
+		}
+		return ErrInvalidBoundaryCharacter
+	}
+	return nil
+}
+
+// canonicalHeader returns the header with keys in the canonical MIME casing,
+// so that they can be found by Get. Manually constructed headers with other
+// keys are copied, other headers are returned as-is.
+func canonicalHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	canonical := true
+	for key := range header {
+		if key != textproto.CanonicalMIMEHeaderKey(key) {
+			canonical = false
+			break
+		}
+	}
+	if canonical {
+		return header
+	}
+	clone := make(textproto.MIMEHeader, len(header))
+	for key, values := range header {
+		key = textproto.CanonicalMIMEHeaderKey(key)
+		clone[key] = append(clone[key], values...)
+	}
+	return clone
+}
+
+func cloneHeader(header textproto.MIMEHeader) textproto.MIMEHeader {
+	clone := make(textproto.MIMEHeader, len(header))
+	for key, values := range header {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 
-func escapeQuotes(value string) string {
+// EscapeQuotes escapes backslashes and double quotes in the value the same
+// way as the methods adding parts do, before the value is enclosed in double
+// quotes in a header parameter. It is useful for constructing headers
+// for AddPart manually:
+//
+//     header.Set("Content-Disposition",
+//       `form-data; name="`+composer.EscapeQuotes(name)+`"`)
+func EscapeQuotes(value string) string {
 	return quoteEscaper.Replace(value)
 }
 
-func randomBoundary() string {
-	var buf [30]byte
-	_, err := io.ReadFull(rand.Reader, buf[:])
+// maxParamLength is the maximum length of a parameter value, or of its
+// segment, encoded according to RFC 2231.
+const maxParamLength = 64
+
+// dispositionParam formats a parameter of Content-Disposition, including
+// the leading separator. If RFC2231Params is set, values with non-ASCII
+// characters, or longer than maxParamLength, are encoded according
+// to RFC 2231.
+func (c *Composer) dispositionParam(key, value string) string {
+	if !c.RFC2231Params || len(value) <= maxParamLength && isPrintableASCII(value) {
+		return fmt.Sprintf(`; %s="%s"`, key, EscapeQuotes(value))
+	}
+	encoded := "utf-8''" + percentEncode(value)
+	if len(encoded) <= maxParamLength {
+		return fmt.Sprintf("; %s*=%s", key, encoded)
+	}
+	var buf strings.Builder
+	for i := 0; len(encoded) > 0; i++ {
+		end := maxParamLength
+		if end >= len(encoded) {
+			end = len(encoded)
+		} else if percent := strings.LastIndexByte(encoded[end-2:end], '%'); percent >= 0 {
+			// do not split an escaped octet
+			end -= 2 - percent
+		}
+		fmt.Fprintf(&buf, "; %s*%d*=%s", key, i, encoded[:end])
+		encoded = encoded[end:]
+	}
+	return buf.String()
+}
+
+func isPrintableASCII(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < ' ' || value[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// percentEncode escapes all octets except for attribute-char of RFC 2231.
+func percentEncode(value string) string {
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// Counts of random bytes used to generate a boundary; the maximum makes
+// 70 hexadecimal digits.
+const (
+	defaultBoundaryLength = 30
+	maxBoundaryLength     = 35
+)
+
+func randomBoundary(length int) string {
+	buf := make([]byte, length)
+	_, err := io.ReadFull(rand.Reader, buf)
 	if err != nil {
 		panic(err)
 	}
-	return fmt.Sprintf("%x", buf[:])
+	return fmt.Sprintf("%x", buf)
 }
@@ -0,0 +1,42 @@
+package composer_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	composer "github.com/prantlf/go-multipart-composer"
+)
+
+var benchContent = make([]byte, 16*1024*1024)
+
+// writerOnly hides io.ReaderFrom of the target writer to make io.CopyBuffer
+// use the supplied buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+func benchmarkWriteTo(b *testing.B, bufferSize int) {
+	b.SetBytes(int64(len(benchContent)))
+	for i := 0; i < b.N; i++ {
+		comp := composer.NewComposer()
+		comp.CopyBufferSize = bufferSize
+		comp.AddFileReader("file", "test.bin", bytes.NewReader(benchContent))
+		if _, err := comp.WriteTo(writerOnly{ioutil.Discard}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComposer_WriteTo_default(b *testing.B) {
+	benchmarkWriteTo(b, 0)
+}
+
+func BenchmarkComposer_WriteTo_32k(b *testing.B) {
+	benchmarkWriteTo(b, 32*1024)
+}
+
+func BenchmarkComposer_WriteTo_256k(b *testing.B) {
+	benchmarkWriteTo(b, 256*1024)
+}
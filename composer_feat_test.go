@@ -1,13 +1,29 @@
 package composer_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	composer "github.com/prantlf/go-multipart-composer"
+	"github.com/prantlf/go-sizeio"
 )
 
 func TestComposer_SetBoundary_simple(t *testing.T) {
@@ -217,3 +233,2224 @@ func TestComposer_AddPart_2parts(t *testing.T) {
 		t.Error("composer: 2 parts not added")
 	}
 }
+
+func TestComposer_BoundaryLine(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("foo")
+	if string(comp.BoundaryLine()) != "--foo\r\n" {
+		t.Error("composer: unexpected boundary line")
+	}
+	comp.AddField("name", "value")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.HasPrefix(string(out), string(comp.BoundaryLine())) {
+		t.Error("composer: boundary line not emitted")
+	}
+}
+
+func TestComposer_ClosingBoundaryLine(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("foo")
+	if string(comp.ClosingBoundaryLine()) != "\r\n--foo--\r\n" {
+		t.Error("composer: unexpected closing boundary line")
+	}
+	comp.AddField("name", "value")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.HasSuffix(string(out), string(comp.ClosingBoundaryLine())) {
+		t.Error("composer: closing boundary line not emitted")
+	}
+}
+
+func TestComposer_WriteTo(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.CopyBufferSize = 4
+	comp.AddField("name", "value")
+	var buf strings.Builder
+	size, err := comp.WriteTo(&buf)
+	if err != nil {
+		t.Error("composer: write failed -", err)
+	}
+	if size != int64(buf.Len()) || !strings.Contains(buf.String(), "value") {
+		t.Error("composer: content not written")
+	}
+}
+
+func TestComposer_RejectDuplicateFields_unique(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.RejectDuplicateFields = true
+	comp.AddField("foo", "bar")
+	comp.AddFieldReader("bar", strings.NewReader("baz"))
+	if err := comp.Err(); err != nil {
+		t.Error("composer: unique fields rejected -", err)
+	}
+}
+
+func TestComposer_RejectDuplicateFields_duplicate(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.RejectDuplicateFields = true
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("foo", "test.txt", strings.NewReader("baz"))
+	if comp.Err() == nil {
+		t.Error("composer: duplicate field accepted")
+	}
+	comp.Clear()
+	if comp.Err() != nil {
+		t.Error("composer: error not cleared")
+	}
+}
+
+func TestComposer_RejectDuplicateFields_disabled(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddField("foo", "baz")
+	if err := comp.Err(); err != nil {
+		t.Error("composer: duplicate field rejected -", err)
+	}
+}
+
+func TestComposer_AddFieldList(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.RejectDuplicateFields = true
+	comp.AddFieldList("foo", []string{"bar", "baz"})
+	if err := comp.Err(); err != nil {
+		t.Error("composer: field list rejected -", err)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if strings.Count(string(out), "name=\"foo\"") != 2 {
+		t.Error("composer: field list not added")
+	}
+}
+
+func TestComposer_AddJSONField_plain(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddJSONField("foo", []int{1, 2}); err != nil {
+		t.Error("composer: serialization failed -", err)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.Contains(string(out), "\r\n\r\n[1,2]\r\n") ||
+		strings.Contains(string(out), "Content-Type") {
+		t.Error("composer: unexpected JSON field")
+	}
+}
+
+func TestComposer_AddJSONField_invalid(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddJSONField("foo", func() {}); err == nil {
+		t.Error("composer: invalid JSON serialized")
+	}
+}
+
+func TestComposer_Close_fields(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	if err := comp.Close(); err != nil {
+		t.Error(err)
+	}
+	if comp.IsEmpty() {
+		t.Error("composer: fields released")
+	}
+}
+
+func TestComposer_Close_retained(t *testing.T) {
+	comp := composer.NewComposer()
+	closer := &failingCloser{strings.NewReader("bar"), errors.New("closed twice")}
+	comp.AddFieldReader("foo", closer)
+	if err := comp.Close(); err == nil {
+		t.Error("composer: owned reader not closed")
+	}
+	if comp.IsEmpty() {
+		t.Error("composer: parts released")
+	}
+	if err := comp.Close(); err != nil {
+		t.Error("composer: reader closed again -", err)
+	}
+}
+
+func TestComposer_Close_twice(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error("composer: file not added -", err)
+	}
+	if err := comp.Close(); err != nil {
+		t.Error("composer: first close failed -", err)
+	}
+	if err := comp.Close(); err != nil {
+		t.Error("composer: second close failed -", err)
+	}
+}
+
+func TestComposer_Close_detached(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error("composer: file not added -", err)
+	}
+	reqBody := comp.DetachReader()
+	if err := reqBody.Close(); err != nil {
+		t.Error("composer: reader close failed -", err)
+	}
+	if err := reqBody.Close(); err != nil {
+		t.Error("composer: second reader close failed -", err)
+	}
+	if err := comp.Close(); err != nil {
+		t.Error("composer: close after detach failed -", err)
+	}
+}
+
+func TestComposer_DetachReaderWithSize_retry(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", ioutil.NopCloser(strings.NewReader("bar")))
+	if _, _, err := comp.DetachReaderWithSize(); err == nil {
+		t.Error("composer: reader without size accepted")
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if strings.Count(string(out), comp.Boundary()+"--") != 1 {
+		t.Error("composer: closing boundary repeated")
+	}
+}
+
+func TestComposer_AddGroupMarker(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddGroupMarker("group")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.Contains(string(out), "Content-Disposition: form-data; name=\"group\"\r\nX-Group: end\r\n\r\n\r\n--") {
+		t.Error("composer: group marker not added")
+	}
+}
+
+func TestComposer_DetachReader_bytesRead(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	reqBody := comp.DetachReader()
+	counter, ok := reqBody.(composer.ReadCounter)
+	if !ok {
+		t.Fatal("composer: read counter not implemented")
+	}
+	if counter.BytesRead() != 0 {
+		t.Error("composer: bytes read before reading")
+	}
+	out, _ := ioutil.ReadAll(reqBody)
+	if counter.BytesRead() != int64(len(out)) {
+		t.Error("composer: unexpected count of bytes read")
+	}
+}
+
+func TestComposer_SetBoundaryFromContentType_quoted(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundaryFromContentType(`multipart/mixed; boundary="foo / bar"`); err != nil {
+		t.Error("composer: quoted failed -", err)
+	}
+	if comp.Boundary() != "foo / bar" {
+		t.Error("composer: quoted not set")
+	}
+}
+
+func TestComposer_SetBoundaryFromContentType_invalid(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundaryFromContentType("multipart/form-data; boundary"); err == nil {
+		t.Error("composer: invalid succeeded")
+	}
+}
+
+func TestComposer_SetBoundaryFromContentType_other(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundaryFromContentType("text/plain; boundary=foo"); err == nil {
+		t.Error("composer: other succeeded")
+	}
+}
+
+func TestComposer_SetBoundaryFromContentType_missing(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundaryFromContentType("multipart/form-data"); err == nil {
+		t.Error("composer: missing succeeded")
+	}
+}
+
+func TestComposer_DetachReaderWithExplicitSize(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", ioutil.NopCloser(strings.NewReader("bar")))
+	reqBody := comp.DetachReaderWithExplicitSize(42)
+	withSize, ok := reqBody.(sizeio.WithSize)
+	if !ok {
+		t.Fatal("composer: size not provided")
+	}
+	if withSize.Size() != 42 {
+		t.Error("composer: unexpected size")
+	}
+	if out, _ := ioutil.ReadAll(reqBody); !strings.Contains(string(out), "bar") {
+		t.Error("composer: content not read")
+	}
+}
+
+func TestComposer_AddFiles(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.RejectDuplicateFields = true
+	if err := comp.AddFiles("files", []string{"demo/test.txt", "demo/test.bin"}); err != nil {
+		t.Error("composer: files not added -", err)
+	}
+	if err := comp.Err(); err != nil {
+		t.Error("composer: files rejected -", err)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.Contains(string(out), "name=\"files\"; filename=\"test.txt\"") ||
+		!strings.Contains(string(out), "name=\"files\"; filename=\"test.bin\"") {
+		t.Error("composer: files missing")
+	}
+}
+
+func TestComposer_AddFiles_missing(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddFiles("files", []string{"demo/test.txt", "missing.txt"}); err == nil {
+		t.Error("composer: missing file added")
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if string(out) != string(comp.ClosingBoundaryLine()) {
+		t.Error("composer: partial files added")
+	}
+}
+
+func TestComposer_AddFileObjectNamed(t *testing.T) {
+	comp := composer.NewComposer()
+	file, _ := os.Open("demo/test.bin")
+	defer file.Close()
+	if err := comp.AddFileObjectNamed("file", "test.txt", file); err != nil {
+		t.Error("composer: file object not added -", err)
+	}
+	out, size, _ := comp.DetachReaderWithSize()
+	content, _ := ioutil.ReadAll(out)
+	if !strings.Contains(string(content), "filename=\"test.txt\"\r\nContent-Type: text/plain") ||
+		size != int64(len(content)) {
+		t.Error("composer: unexpected file object")
+	}
+}
+
+func TestComposer_CreatePartWithType(t *testing.T) {
+	comp := composer.NewComposer()
+	part := comp.CreatePartWithType("attachment", map[string]string{"filename": "x"})
+	if part.Get("Content-Disposition") != "attachment; filename=\"x\"" {
+		t.Error("composer: unexpected disposition")
+	}
+}
+
+func TestComposer_AddFileReader_nil(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReader("file", "test.txt", nil)
+	if comp.Err() == nil {
+		t.Error("composer: nil reader accepted")
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if string(out) != string(comp.ClosingBoundaryLine()) {
+		t.Error("composer: part with nil reader added")
+	}
+}
+
+func TestComposer_AddPart_nil(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddPart(comp.CreateFieldPart("field"), nil)
+	if comp.Err() == nil {
+		t.Error("composer: nil reader accepted")
+	}
+}
+
+func TestComposer_AddPart_nilHeader(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	comp.AddPart(nil, strings.NewReader("content"))
+	expected := "--3a494cd3\r\n\r\ncontent\r\n--3a494cd3--\r\n"
+	if size, _ := comp.Size(); size != int64(len(expected)) {
+		t.Errorf("composer: unexpected size %d", size)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if string(out) != expected {
+		t.Errorf("composer: unexpected output %q", out)
+	}
+}
+
+func TestComposer_HasClosableReaders(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	if comp.HasClosableReaders() {
+		t.Error("composer: closable readers reported for a field")
+	}
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error("composer: file not added -", err)
+	}
+	if !comp.HasClosableReaders() {
+		t.Error("composer: closable readers not reported for a file")
+	}
+	comp.Close()
+	if !comp.HasClosableReaders() {
+		t.Error("composer: closable readers not reported after close")
+	}
+}
+
+func TestComposer_AddGraphQLUpload(t *testing.T) {
+	comp := composer.NewComposer()
+	operations := map[string]interface{}{
+		"query":     "mutation ($file: Upload!) { upload(file: $file) { id } }",
+		"variables": map[string]interface{}{"file": nil},
+	}
+	fileMap := map[string][]string{"0": {"variables.file"}}
+	files := []io.Reader{strings.NewReader("test")}
+	if err := comp.AddGraphQLUpload(operations, fileMap, files); err != nil {
+		t.Error("composer: upload not added -", err)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	operationsIndex := strings.Index(string(out), "name=\"operations\"\r\n\r\n{\"query\":")
+	mapIndex := strings.Index(string(out), "name=\"map\"\r\n\r\n{\"0\":[\"variables.file\"]}")
+	fileIndex := strings.Index(string(out), "name=\"0\"; filename=\"0\"")
+	if operationsIndex < 0 || mapIndex < operationsIndex || fileIndex < mapIndex {
+		t.Error("composer: unexpected upload")
+	}
+}
+
+func TestComposer_AddGraphQLUpload_unknown(t *testing.T) {
+	comp := composer.NewComposer()
+	fileMap := map[string][]string{"1": {"variables.file"}}
+	files := []io.Reader{strings.NewReader("test")}
+	if err := comp.AddGraphQLUpload(nil, fileMap, files); err == nil {
+		t.Error("composer: unknown file index accepted")
+	}
+	if !comp.IsEmpty() {
+		t.Error("composer: parts added")
+	}
+}
+
+func TestComposer_AddGraphQLUpload_nil(t *testing.T) {
+	comp := composer.NewComposer()
+	fileMap := map[string][]string{"0": {"variables.file"}}
+	files := []io.Reader{nil}
+	if err := comp.AddGraphQLUpload(nil, fileMap, files); !errors.Is(err, composer.ErrNilReader) {
+		t.Error("composer: unexpected error -", err)
+	}
+	if count := len(comp.PartInfos()); count != 0 {
+		t.Error("composer: unexpected part count -", count)
+	}
+	if err := comp.Err(); err != nil {
+		t.Error("composer: error recorded -", err)
+	}
+}
+
+func TestComposer_Size(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error("composer: file not added -", err)
+	}
+	size, err := comp.Size()
+	if err != nil {
+		t.Error("composer: size failed -", err)
+	}
+	out, detachedSize, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Error("composer: detach failed -", err)
+	}
+	content, _ := ioutil.ReadAll(out)
+	if size != detachedSize || size != int64(len(content)) {
+		t.Error("composer: sizes do not match")
+	}
+}
+
+func TestComposer_Size_seeker(t *testing.T) {
+	comp := composer.NewComposer()
+	file, _ := os.Open("demo/test.txt")
+	file.Seek(5, io.SeekStart)
+	comp.AddFileReader("file", "test.txt", file)
+	size, err := comp.Size()
+	if err != nil {
+		t.Error("composer: seeker size failed -", err)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if size != int64(len(out)) {
+		t.Error("composer: unexpected seeker size")
+	}
+}
+
+func TestComposer_PrependFieldReader(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("foo")
+	comp.PrependFieldReader("b", strings.NewReader("2"))
+	comp.PrependFileReader("a", "a.txt", strings.NewReader("1"))
+	comp.AddField("c", "3")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	expected := "--foo\r\nContent-Disposition: form-data; name=\"a\"; filename=\"a.txt\"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n1" +
+		"\r\n--foo\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\n2" +
+		"\r\n--foo\r\nContent-Disposition: form-data; name=\"c\"\r\n\r\n3" +
+		"\r\n--foo--\r\n"
+	if string(out) != expected {
+		t.Error("composer: unexpected order of prepended parts")
+	}
+}
+
+func TestComposer_PrependPart_nil(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.PrependPart(comp.CreateFieldPart("baz"), nil)
+	if comp.Err() == nil {
+		t.Error("composer: nil reader accepted")
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.HasPrefix(string(out), string(comp.BoundaryLine())+"Content-Disposition: form-data; name=\"foo\"") {
+		t.Error("composer: first part replaced")
+	}
+}
+
+func TestComposer_AddFileReaderGzip(t *testing.T) {
+	content := strings.Repeat("test", 1000)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(content))
+	writer.Close()
+
+	comp := composer.NewComposer()
+	comp.AddFileReaderGzip("file", "test.txt", strings.NewReader(content), int64(compressed.Len()))
+	out, size, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Fatal("composer: size not computed -", err)
+	}
+	body, _ := ioutil.ReadAll(out)
+	if size != int64(len(body)) {
+		t.Error("composer: unexpected compressed size")
+	}
+	if !bytes.Contains(body, []byte("Content-Encoding: gzip\r\n")) ||
+		!bytes.Contains(body, compressed.Bytes()) {
+		t.Error("composer: unexpected compressed content")
+	}
+}
+
+func TestComposer_AddFileReaderGzip_nosize(t *testing.T) {
+	comp := composer.NewComposer()
+	file, _ := os.Open("demo/test.txt")
+	comp.AddFileReaderGzip("file", "test.txt", file, -1)
+	if _, err := comp.Size(); err == nil {
+		t.Error("composer: unknown compressed size computed")
+	}
+	if !comp.HasClosableReaders() {
+		t.Error("composer: compressed file not closable")
+	}
+	comp.Close()
+	if _, err := file.Stat(); err == nil {
+		t.Error("composer: compressed file not closed")
+	}
+}
+
+func TestComposer_AddFieldTrimmed(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldTrimmed("a", "1\n")
+	comp.AddFieldTrimmed("b", "2\r\n")
+	comp.AddFieldTrimmed("c", "3\n\n")
+	comp.AddFieldTrimmed("d", "4\r")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.Contains(string(out), "\r\n\r\n1\r\n--") ||
+		!strings.Contains(string(out), "\r\n\r\n2\r\n--") ||
+		!strings.Contains(string(out), "\r\n\r\n3\n\r\n--") ||
+		!strings.Contains(string(out), "\r\n\r\n4\r\r\n--") {
+		t.Error("composer: unexpected trimmed values")
+	}
+}
+
+func TestComposer_SortParts(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("b", "2")
+	comp.AddRawPart([]byte("Content-Disposition: form-data; name=\"c\"\r\n\r\n3"))
+	comp.AddField("a", "1")
+	comp.SortParts(func(a, b composer.Part) bool {
+		return a.Name() < b.Name()
+	})
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	raw := strings.Index(string(out), "name=\"c\"")
+	first := strings.Index(string(out), "name=\"a\"")
+	second := strings.Index(string(out), "name=\"b\"")
+	if raw < 0 || first < raw || second < first {
+		t.Error("composer: unexpected order of sorted parts")
+	}
+}
+
+func TestComposer_DetachReaderLimited_within(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	out, err := ioutil.ReadAll(comp.DetachReaderLimited(size))
+	if err != nil {
+		t.Error("composer: limited reading failed -", err)
+	}
+	if int64(len(out)) != size {
+		t.Error("composer: limited content truncated")
+	}
+}
+
+func TestComposer_DetachReaderLimited_exceeded(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	if _, err := ioutil.ReadAll(comp.DetachReaderLimited(size - 1)); err == nil {
+		t.Error("composer: limit not enforced")
+	}
+}
+
+func TestComposer_PartSize(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", ioutil.NopCloser(strings.NewReader("bar")))
+	comp.AddField("baz", "qux")
+	if _, ok := comp.PartSize(0); ok {
+		t.Error("composer: unknown part size computed")
+	}
+	size, ok := comp.PartSize(1)
+	if !ok {
+		t.Error("composer: known part size not computed")
+	}
+	expected := "\r\n" + string(comp.BoundaryLine()) +
+		"Content-Disposition: form-data; name=\"baz\"\r\n\r\nqux"
+	if size != int64(len(expected)) {
+		t.Error("composer: unexpected part size")
+	}
+	if _, ok := comp.PartSize(2); ok {
+		t.Error("composer: missing part size computed")
+	}
+}
+
+type failingCloser struct {
+	io.Reader
+	err error
+}
+
+func (r failingCloser) Close() error {
+	return r.err
+}
+
+func TestComposer_JoinCloseErrors(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	comp := composer.NewComposer()
+	comp.JoinCloseErrors = true
+	comp.AddFieldReader("foo", failingCloser{strings.NewReader("bar"), first})
+	comp.AddFieldReader("baz", failingCloser{strings.NewReader("qux"), second})
+	err := comp.DetachReader().Close()
+	errs, ok := err.(composer.CloseErrors)
+	if !ok || len(errs) != 2 || errs[0] != first || errs[1] != second {
+		t.Error("composer: unexpected close errors -", err)
+	}
+}
+
+func TestComposer_JoinCloseErrors_unwrap(t *testing.T) {
+	first := errors.New("first")
+	second := &os.PathError{Op: "close", Path: "test.txt", Err: os.ErrClosed}
+	comp := composer.NewComposer()
+	comp.JoinCloseErrors = true
+	comp.AddFieldReader("foo", failingCloser{strings.NewReader("bar"), first})
+	comp.AddFieldReader("baz", failingCloser{strings.NewReader("qux"), second})
+	err := comp.DetachReader().Close()
+	if !errors.Is(err, first) || !errors.Is(err, os.ErrClosed) {
+		t.Error("composer: contained error not found -", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr != second {
+		t.Error("composer: contained error not assigned -", err)
+	}
+}
+
+func TestComposer_JoinCloseErrors_disabled(t *testing.T) {
+	first, second := errors.New("first"), errors.New("second")
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", failingCloser{strings.NewReader("bar"), first})
+	comp.AddFieldReader("baz", failingCloser{strings.NewReader("qux"), second})
+	if err := comp.Close(); err != first {
+		t.Error("composer: unexpected close error -", err)
+	}
+}
+
+func TestComposer_DetachReaderControlled_throttled(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	start := time.Now()
+	out, err := ioutil.ReadAll(comp.DetachReaderControlled(context.Background(), size*10))
+	if err != nil {
+		t.Error("composer: controlled reading failed -", err)
+	}
+	if int64(len(out)) != size {
+		t.Error("composer: controlled content truncated")
+	}
+	if time.Since(start) < 90*time.Millisecond {
+		t.Error("composer: reading not throttled")
+	}
+}
+
+func TestComposer_DetachReaderControlled_cancelled(t *testing.T) {
+	comp := composer.NewComposer()
+	file, _ := os.Open("demo/test.txt")
+	comp.AddFileReader("file", "test.txt", file)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reqBody := comp.DetachReaderControlled(ctx, 0)
+	if _, err := ioutil.ReadAll(reqBody); err != context.Canceled {
+		t.Error("composer: cancellation ignored -", err)
+	}
+	reqBody.Close()
+	if _, err := file.Stat(); err == nil {
+		t.Error("composer: file not closed")
+	}
+}
+
+func TestComposer_Validate_valid(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error("composer: file not added -", err)
+	}
+	defer comp.Close()
+	if err := comp.Validate(); err != nil {
+		t.Error("composer: valid message rejected -", err)
+	}
+}
+
+func TestComposer_Validate_disposition(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddPart(textproto.MIMEHeader{"Content-Type": {"text/plain"}}, strings.NewReader("foo"))
+	if err := comp.Validate(); err == nil {
+		t.Error("composer: missing disposition accepted")
+	}
+}
+
+func TestComposer_Validate_header(t *testing.T) {
+	comp := composer.NewComposer()
+	header := comp.CreateFieldPart("foo")
+	header.Set("X-Test", "bar\r\nbaz")
+	comp.AddPart(header, strings.NewReader("qux"))
+	if err := comp.Validate(); err == nil {
+		t.Error("composer: line break in header accepted")
+	}
+}
+
+func TestComposer_Validate_content(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("foo")
+	comp.AddField("bar", "baz\r\n--foo")
+	if err := comp.Validate(); err == nil {
+		t.Error("composer: boundary in content accepted")
+	}
+}
+
+func TestComposer_Validate_boundary(t *testing.T) {
+	comp := composer.Composer{}
+	if err := comp.Validate(); err == nil {
+		t.Error("composer: empty boundary accepted")
+	}
+}
+
+func TestComposer_DetachReaderTee(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	var archive bytes.Buffer
+	out, _ := ioutil.ReadAll(comp.DetachReaderTee(&archive))
+	if !bytes.Equal(out, archive.Bytes()) {
+		t.Error("composer: archived content differs")
+	}
+}
+
+func TestComposer_AsPart(t *testing.T) {
+	inner := composer.NewComposer()
+	inner.SetBoundary("inner")
+	inner.AddField("foo", "bar")
+	comp := composer.NewComposer()
+	comp.SetBoundary("outer")
+	comp.AddPart(inner.AsPart("nested"))
+	out, size, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Fatal("composer: nested size not computed -", err)
+	}
+	content, _ := ioutil.ReadAll(out)
+	expected := "--outer\r\nContent-Disposition: form-data; name=\"nested\"\r\n" +
+		"Content-Type: multipart/form-data; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n--inner--\r\n" +
+		"\r\n--outer--\r\n"
+	if string(content) != expected || size != int64(len(content)) {
+		t.Error("composer: unexpected nested message")
+	}
+}
+
+func TestComposer_AssumeUTF8Text(t *testing.T) {
+	mime.AddExtensionType(".tst", "text/x-test")
+	comp := composer.NewComposer()
+	comp.AssumeUTF8Text = true
+	header := comp.CreateFilePart("file", "test.tst")
+	if header.Get("Content-Type") != "text/x-test; charset=utf-8" {
+		t.Error("composer: charset not added -", header.Get("Content-Type"))
+	}
+	header = comp.CreateFilePart("file", "test.txt")
+	if header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Error("composer: charset repeated -", header.Get("Content-Type"))
+	}
+	header = comp.CreateFilePart("file", "test.bin")
+	if header.Get("Content-Type") != "application/octet-stream" {
+		t.Error("composer: charset added to binary -", header.Get("Content-Type"))
+	}
+}
+
+func TestComposer_Parts(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "1")
+	comp.AddFileReader("bar", "test.txt", strings.NewReader("2"))
+	comp.AddField("baz", "3")
+	var names []string
+	comp.Parts()(func(name string, header textproto.MIMEHeader) bool {
+		names = append(names, name)
+		header.Set("X-Test", "test")
+		return name != "bar"
+	})
+	if strings.Join(names, ",") != "foo,bar" {
+		t.Error("composer: unexpected iterated parts -", names)
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if strings.Contains(string(out), "X-Test") {
+		t.Error("composer: iterated header modified")
+	}
+}
+
+func TestComposer_AddFileReaderOwned(t *testing.T) {
+	owned, shared := errors.New("owned"), errors.New("shared")
+	comp := composer.NewComposer()
+	comp.CloseReaders = false
+	comp.AddFileReaderOwned("foo", "foo.txt", failingCloser{strings.NewReader("bar"), owned}, true)
+	comp.AddFileReaderOwned("baz", "baz.txt", failingCloser{strings.NewReader("qux"), shared}, false)
+	if err := comp.DetachReader().Close(); err != owned {
+		t.Error("composer: unexpected close error -", err)
+	}
+}
+
+func TestComposer_AddFile_owned(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.CloseReaders = false
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !comp.HasClosableReaders() {
+		t.Error("composer: file not added")
+	}
+	if err := comp.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := comp.ClosableReaders()[0].Close(); !errors.Is(err, os.ErrClosed) {
+		t.Error("composer: owned file not closed")
+	}
+}
+
+func TestComposer_BoundaryOverhead(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundary("b"); err != nil {
+		t.Fatal(err)
+	}
+	if overhead := comp.BoundaryOverhead(0); overhead != 9 {
+		t.Error("composer: unexpected overhead without parts -", overhead)
+	}
+	comp.AddField("foo", "")
+	comp.AddField("bar", "")
+	comp.AddField("baz", "")
+	size, _ := comp.Size()
+	// each field header is 46 bytes long, without the boundary line
+	if overhead := comp.BoundaryOverhead(3); overhead != size-3*46 || overhead != 28 {
+		t.Error("composer: unexpected overhead -", overhead, size)
+	}
+}
+
+func TestComposer_AppendToLastPart(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", strings.NewReader("bar"))
+	comp.AppendToLastPart(strings.NewReader("baz"))
+	size, _ := comp.Size()
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("\r\n\r\nbarbaz\r\n--")) || int64(len(body)) != size {
+		t.Error("composer: unexpected body -", string(body))
+	}
+}
+
+func TestComposer_AppendToLastPart_empty(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AppendToLastPart(strings.NewReader("baz"))
+	if comp.Err() == nil {
+		t.Error("composer: appending without parts accepted")
+	}
+}
+
+func TestNewComposerWithBoundaryLength(t *testing.T) {
+	comp, err := composer.NewComposerWithBoundaryLength(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if boundary := comp.Boundary(); len(boundary) != 8 {
+		t.Error("composer: unexpected boundary -", boundary)
+	}
+	if err := comp.ResetBoundary(); err != nil {
+		t.Fatal(err)
+	}
+	if boundary := comp.Boundary(); len(boundary) != 8 {
+		t.Error("composer: unexpected reset boundary -", boundary)
+	}
+	comp, err = composer.NewComposerWithBoundaryLength(35)
+	if err != nil || len(comp.Boundary()) != 70 {
+		t.Error("composer: unexpected longest boundary -", err)
+	}
+}
+
+func TestNewComposerWithBoundaryLength_invalid(t *testing.T) {
+	for _, length := range []int{0, 36} {
+		if _, err := composer.NewComposerWithBoundaryLength(length); err == nil {
+			t.Error("composer: invalid boundary length accepted -", length)
+		}
+	}
+}
+
+func TestComposer_VerifySizes(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.VerifySizes = true
+	comp.AddFileReader("file", "test.txt", sizeio.SizeReader(strings.NewReader("short"), 10))
+	reader := comp.DetachReader()
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err == nil {
+		t.Error("composer: truncated reader not detected")
+	}
+}
+
+func TestComposer_VerifySizes_valid(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.VerifySizes = true
+	comp.AddFileReader("file", "test.txt", sizeio.SizeReader(strings.NewReader("exact"), 5))
+	if _, err := comp.WriteTo(ioutil.Discard); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComposer_AddFileReaderPadded(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReaderPadded("file", "test.bin", strings.NewReader("0123456789abc"), 16)
+	comp.AddFileReaderPadded("full", "full.bin", strings.NewReader("0123"), 4)
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("\r\n\r\n0123456789abc\x03\x03\x03\r\n")) ||
+		!bytes.Contains(body, []byte("\r\n\r\n0123\x04\x04\x04\x04\r\n")) ||
+		int64(len(body)) != size {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddFileReaderPadded_invalid(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReaderPadded("file", "test.bin", strings.NewReader("0123"), 0)
+	if comp.Err() == nil {
+		t.Error("composer: invalid block size accepted")
+	}
+	comp.Clear()
+	comp.AddFileReaderPadded("file", "test.bin", ioutil.NopCloser(strings.NewReader("0123")), 16)
+	if comp.Err() == nil {
+		t.Error("composer: reader without size accepted")
+	}
+}
+
+func TestComposer_AddFileGroup(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileGroup("files", []composer.FilePart{
+		{"a.txt", strings.NewReader("first")},
+		{"b.json", strings.NewReader("{}")},
+	})
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+	form := multipart.NewReader(bytes.NewReader(body), comp.Boundary())
+	group, err := form.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(group.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || group.FormName() != "files" {
+		t.Fatal("composer: unexpected group -", group.Header)
+	}
+	files := multipart.NewReader(group, params["boundary"])
+	for _, expected := range []string{"a.txt:first", "b.json:{}"} {
+		file, err := files.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(file)
+		if actual := file.FileName() + ":" + string(content); actual != expected {
+			t.Error("composer: unexpected file -", actual)
+		}
+	}
+	if _, err := files.NextPart(); err != io.EOF {
+		t.Error("composer: unexpected file end -", err)
+	}
+}
+
+func TestComposer_AddFileGroup_configuration(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.DefaultContentType = "application/x-binary"
+	comp.AddFileGroup("files", []composer.FilePart{
+		{"a.unknown", strings.NewReader("first")},
+	})
+	form := multipart.NewReader(comp.DetachReader(), comp.Boundary())
+	group, err := form.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, _ := mime.ParseMediaType(group.Header.Get("Content-Type"))
+	file, err := multipart.NewReader(group, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := file.Header.Get("Content-Type"); contentType != "application/x-binary" {
+		t.Error("composer: unexpected content type -", contentType)
+	}
+}
+
+func TestNewComposer_options(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"),
+		composer.WithoutCloseReaders(), composer.WithMaxSize(10))
+	if comp.Boundary() != "b" || comp.CloseReaders || comp.MaxSize != 10 || comp.Err() != nil {
+		t.Error("composer: options not applied")
+	}
+	comp.AddField("foo", "bar")
+	if _, err := ioutil.ReadAll(comp.DetachReader()); err == nil {
+		t.Error("composer: size limit not applied")
+	}
+}
+
+func TestNewComposer_invalidOption(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary(""))
+	if comp.Err() == nil {
+		t.Error("composer: invalid boundary accepted")
+	}
+}
+
+func TestComposer_NoClosingDelimiter(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	comp.NoClosingDelimiter = true
+	comp.AddField("foo", "bar")
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n\r\nbar")) || int64(len(body)) != size {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_DetachReaderWithCRC32C(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	reader, checksum := comp.DetachReaderWithCRC32C()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))
+	if actual := checksum(); actual != expected {
+		t.Error("composer: unexpected checksum -", actual, expected)
+	}
+}
+
+func TestComposer_AddFieldExpanded(t *testing.T) {
+	os.Setenv("COMPOSER_TEST_HOST", "localhost")
+	defer os.Unsetenv("COMPOSER_TEST_HOST")
+	comp := composer.NewComposer()
+	comp.AddFieldExpanded("url", "http://${COMPOSER_TEST_HOST}/$COMPOSER_TEST_PATH")
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("\r\n\r\nhttp://localhost/\r\n")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_SetBoundaryPrefix(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundaryPrefix("level1-"); err != nil {
+		t.Fatal(err)
+	}
+	if boundary := comp.Boundary(); !strings.HasPrefix(boundary, "level1-") || len(boundary) != 67 {
+		t.Error("composer: unexpected boundary -", boundary)
+	}
+	if err := comp.ResetBoundary(); err != nil {
+		t.Fatal(err)
+	}
+	if boundary := comp.Boundary(); !strings.HasPrefix(boundary, "level1-") {
+		t.Error("composer: unexpected reset boundary -", boundary)
+	}
+}
+
+func TestComposer_SetBoundaryPrefix_invalid(t *testing.T) {
+	comp := composer.NewComposer()
+	boundary := comp.Boundary()
+	for _, prefix := range []string{"level;", "longer-than-10-"} {
+		if err := comp.SetBoundaryPrefix(prefix); err == nil {
+			t.Error("composer: invalid prefix accepted -", prefix)
+		}
+	}
+	if comp.Boundary() != boundary {
+		t.Error("composer: boundary changed")
+	}
+}
+
+func TestComposer_SniffContentType(t *testing.T) {
+	file, err := ioutil.TempFile("", "composer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("<html><body></body></html>"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	comp := composer.NewComposer()
+	comp.SniffContentType = true
+	if err := comp.AddFileObject("file", file); err != nil {
+		t.Fatal(err)
+	}
+	reader := comp.DetachReader()
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("Content-Type: text/html; charset=utf-8\r\n\r\n<html>")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_ClosableReaders(t *testing.T) {
+	comp := composer.NewComposer()
+	file := ioutil.NopCloser(strings.NewReader("bar"))
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", file)
+	closers := comp.ClosableReaders()
+	if len(closers) != 1 || closers[0] != file {
+		t.Error("composer: unexpected closable readers -", closers)
+	}
+}
+
+func TestComposer_AddGzippedFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "composer*.txt.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	writer := gzip.NewWriter(file)
+	if _, err := writer.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	file.Close()
+	comp := composer.NewComposer()
+	if err := comp.AddGzippedFile("file", "", file.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := comp.Size(); err == nil {
+		t.Error("composer: unexpected size")
+	}
+	reader := comp.DetachReader()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Contains(body, []byte(".txt\"\r\nContent-Type: text/plain; charset=utf-8\r\n\r\ntest\r\n")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddGzippedFile_invalid(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.AddGzippedFile("file", "", "demo/test.txt"); err == nil {
+		t.Error("composer: uncompressed file accepted")
+	}
+}
+
+func TestComposer_errors(t *testing.T) {
+	comp := composer.NewComposer()
+	if err := comp.SetBoundary(strings.Repeat("b", 71)); !errors.Is(err, composer.ErrBoundaryTooLong) {
+		t.Error("composer: unexpected boundary error -", err)
+	}
+	comp.AddFieldReader("foo", nil)
+	if err := comp.Err(); !errors.Is(err, composer.ErrNilReader) {
+		t.Error("composer: unexpected add error -", err)
+	}
+	comp.AddFieldReader("foo", ioutil.NopCloser(strings.NewReader("bar")))
+	if _, err := comp.Size(); !errors.Is(err, composer.ErrReaderWithoutSize) {
+		t.Error("composer: unexpected size error -", err)
+	}
+	if err := comp.SetBoundary("b"); err != composer.ErrSetBoundaryAfterAdd {
+		t.Error("composer: unexpected boundary error -", err)
+	}
+}
+
+func TestComposer_AddFileLazy(t *testing.T) {
+	opened := false
+	comp := composer.NewComposer()
+	comp.AddFileLazy("file", "test.txt", func() (io.ReadCloser, error) {
+		opened = true
+		return os.Open("demo/test.txt")
+	})
+	reader := comp.DetachReader()
+	if opened {
+		t.Error("composer: file opened early")
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Error(err)
+	}
+	if !opened || !bytes.Contains(body, []byte("\r\n\r\ntext file content")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddFileLazy_failure(t *testing.T) {
+	failure := errors.New("failure")
+	comp := composer.NewComposer()
+	comp.AddFileLazy("file", "test.txt", func() (io.ReadCloser, error) {
+		return nil, failure
+	})
+	if _, err := ioutil.ReadAll(comp.DetachReader()); err != failure {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_Size_incremental(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddFieldReader("stream", ioutil.NopCloser(strings.NewReader("data")))
+	if _, err := comp.Size(); err == nil {
+		t.Error("composer: unexpected size")
+	}
+	comp.Clear()
+	comp.AddField("foo", "bar")
+	first, _ := comp.Size()
+	comp.PrependField("baz", "qux")
+	comp.AddFileReader("file", "test.txt", strings.NewReader("test"))
+	size, err := comp.Size()
+	if err != nil || size <= first {
+		t.Fatal("composer: unexpected size -", size, err)
+	}
+	comp.HeaderFunc = func(index int, header textproto.MIMEHeader) {}
+	if recomputed, _ := comp.Size(); recomputed != size {
+		t.Error("composer: inconsistent size -", recomputed, size)
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+}
+
+func TestComposer_Size_growingReader(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	var buf bytes.Buffer
+	comp.AddFieldReader("a", &buf)
+	buf.WriteString("hello")
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partSize, _ := comp.PartSize(0)
+	if sum := partSize + int64(len(comp.ClosingBoundaryLine())); sum != size {
+		t.Error("composer: part sizes do not add up -", sum, size)
+	}
+	body, _ := ioutil.ReadAll(comp.DetachReader())
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+}
+
+func TestComposer_Size_delimiterChanged(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddField("baz", "qux")
+	comp.NoDelimiterPrefix = true
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum int64
+	for i := 0; i < 2; i++ {
+		partSize, _ := comp.PartSize(i)
+		sum += partSize
+	}
+	if sum += int64(len(comp.ClosingBoundaryLine())); sum != size {
+		t.Error("composer: part sizes do not add up -", sum, size)
+	}
+	body, _ := ioutil.ReadAll(comp.DetachReader())
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+}
+
+func TestComposer_DispositionType(t *testing.T) {
+	comp := composer.NewComposer()
+	if comp.DispositionType != "form-data" {
+		t.Error("composer: unexpected default disposition type -", comp.DispositionType)
+	}
+	comp.DispositionType = "attachment"
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", strings.NewReader("test"))
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("Content-Disposition: attachment; name=\"foo\"\r\n")) ||
+		!bytes.Contains(body, []byte("Content-Disposition: attachment; name=\"file\"; filename=\"test.txt\"\r\n")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_WriteParts(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", strings.NewReader("test"))
+	var parts []*bytes.Buffer
+	err := comp.WriteParts(func(index int) io.Writer {
+		parts = append(parts, &bytes.Buffer{})
+		return parts[index]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 ||
+		parts[0].String() != "--b\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar" ||
+		parts[1].String() != "\r\n--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"test.txt\"\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n\r\ntest" {
+		t.Errorf("composer: unexpected parts - %q", parts)
+	}
+}
+
+func TestComposer_IsEmpty(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	if !comp.IsEmpty() {
+		t.Error("composer: new composer not empty")
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "\r\n--b--\r\n" {
+		t.Errorf("composer: unexpected empty body - %q", body)
+	}
+	if _, err := multipart.NewReader(bytes.NewReader(body), "b").NextPart(); err != io.EOF {
+		t.Error("composer: empty body not parsed -", err)
+	}
+	comp.AddField("foo", "bar")
+	if comp.IsEmpty() {
+		t.Error("composer: composer with a part empty")
+	}
+}
+
+func TestComposer_DetachReaderSlow(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	start := time.Now()
+	reader := comp.DetachReaderSlow(10 * time.Millisecond)
+	if _, err := reader.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Error("composer: read not delayed -", elapsed)
+	}
+}
+
+func TestComposer_Size_Len(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldReader("foo", bytes.NewBufferString("bar"))
+	reader := strings.NewReader("xxtest")
+	reader.Seek(2, io.SeekStart)
+	comp.AddFileReader("file", "test.txt", reader)
+	reqBody, size, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+}
+
+func TestComposer_AddFileWithType(t *testing.T) {
+	comp := composer.NewComposer()
+	defer comp.Close()
+	if err := comp.AddFileWithType("file", "demo/test.txt", "text/markdown"); err != nil {
+		t.Fatal(err)
+	}
+	if err := comp.AddFileWithType("other", "demo/test.txt", ""); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	comp.Parts()(func(name string, header textproto.MIMEHeader) bool {
+		types = append(types, header.Get("Content-Type"))
+		return true
+	})
+	if len(types) != 2 || types[0] != "text/markdown" || !strings.HasPrefix(types[1], "text/plain") {
+		t.Error("composer: unexpected content types -", types)
+	}
+}
+
+func TestComposer_PreserveHeaderOrder(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	comp.PreserveHeaderOrder = true
+	comp.AddPartOrdered([]composer.HeaderField{
+		{"x-second", "2"},
+		{"Content-Disposition", `form-data; name="foo"`},
+		{"X-Second", "3"},
+	}, strings.NewReader("bar"))
+	size, _ := comp.Size()
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "--b\r\nX-Second: 2\r\nX-Second: 3\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n--b--\r\n"
+	if string(body) != expected || int64(len(body)) != size {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_DetachReaderWithKnownSize(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddFieldReader("stream", ioutil.NopCloser(strings.NewReader("data")))
+	reader, size, unknown := comp.DetachReaderWithKnownSize()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown != 1 || int64(len(body)) != size+4 {
+		t.Error("composer: unexpected known size -", size, unknown, len(body))
+	}
+}
+
+func TestComposer_AddTotalSizeField(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddTotalSizeField("_size")
+	comp.AddField("baz", "qux")
+	other := composer.NewComposer()
+	other.SetBoundary(comp.Boundary())
+	other.AddField("foo", "bar")
+	other.AddField("baz", "qux")
+	expected, _ := other.Size()
+	size, err := comp.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := "\r\n\r\n" + strconv.FormatInt(expected, 10) + "\r\n"
+	if !bytes.Contains(body, []byte(value)) || int64(len(body)) != size {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddTotalSizeField_unknown(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddTotalSizeField("_size")
+	comp.AddFieldReader("stream", ioutil.NopCloser(strings.NewReader("data")))
+	if _, err := ioutil.ReadAll(comp.DetachReader()); !errors.Is(err, composer.ErrReaderWithoutSize) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_RFC2231Params(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.RFC2231Params = true
+	long := strings.Repeat("příliš žluťoučký kůň ", 5)
+	for _, name := range []string{"plain", "žluťoučký", long} {
+		header := comp.CreateFilePart(name, name+".txt")
+		_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params["name"] != name || params["filename"] != name+".txt" {
+			t.Error("composer: unexpected parameters -", header.Get("Content-Disposition"))
+		}
+	}
+	if header := comp.CreateFieldPart("plain"); header.Get("Content-Disposition") != `form-data; name="plain"` {
+		t.Error("composer: unexpected plain header -", header)
+	}
+}
+
+func TestComposer_CreateFilePartWithTypeParams(t *testing.T) {
+	comp := composer.NewComposer()
+	header := comp.CreateFilePartWithTypeParams("file", "test.bin", map[string]string{"name": "x y"})
+	if contentType := header.Get("Content-Type"); contentType != `application/octet-stream; name="x y"` {
+		t.Error("composer: unexpected content type -", contentType)
+	}
+}
+
+func TestComposer_AddIf(t *testing.T) {
+	comp := composer.NewComposer()
+	defer comp.Close()
+	comp.AddFieldIf(false, "skipped", "value")
+	comp.AddFieldIf(true, "foo", "bar")
+	if err := comp.AddFileIf(false, "missing", "demo/missing.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := comp.AddFileIf(true, "file", "demo/test.txt"); err != nil {
+		t.Error(err)
+	}
+	var names []string
+	comp.Parts()(func(name string, header textproto.MIMEHeader) bool {
+		names = append(names, name)
+		return true
+	})
+	if strings.Join(names, ",") != "foo,file" {
+		t.Error("composer: unexpected parts -", names)
+	}
+}
+
+func TestComposer_DebugReaderCount(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddField("baz", "qux")
+	comp.AppendToLastPart(strings.NewReader("quux"))
+	if count := comp.DebugReaderCount(); count != 6 {
+		t.Error("composer: unexpected reader count -", count)
+	}
+}
+
+func TestComposer_DebugString(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", ioutil.NopCloser(strings.NewReader("test")))
+	comp.AddRawPart([]byte("\r\nraw"))
+	expected := "# multipart body, 3 parts, unknown size\n" +
+		"0: foo = \"bar\", 54 bytes\n" +
+		"1: file (test.txt), unknown size\n" +
+		"2: (raw), 12 bytes\n"
+	if actual := comp.DebugString(); actual != expected {
+		t.Errorf("composer: unexpected summary - %q", actual)
+	}
+}
+
+func TestComposer_DefaultContentType(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.DefaultContentType = "application/x-binary"
+	header := comp.CreateFilePart("file", "test.unknown")
+	if contentType := header.Get("Content-Type"); contentType != "application/x-binary" {
+		t.Error("composer: unexpected content type -", contentType)
+	}
+}
+
+func TestComposer_AddFileFromResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("remote"))
+	}))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp := composer.NewComposer()
+	comp.AddFileFromResponse("file", "remote.txt", resp)
+	reqBody, size, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reqBody.Close(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Contains(body, []byte("\r\n\r\nremote\r\n")) || int64(len(body)) != size {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddFieldStripBOM(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFieldStripBOM("foo", "\uFEFFbar")
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("\r\n\r\nbar\r\n")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestComposer_AddFromMultipartReader(t *testing.T) {
+	for _, first := range []bool{true, false} {
+		source := composer.NewComposer()
+		source.AddField("foo", "bar")
+		source.AddField("skipped", "value")
+		source.AddFileReader("file", "test.txt", strings.NewReader("test"))
+		comp := composer.NewComposer()
+		if !first {
+			comp.AddField("before", "1")
+		}
+		reader := multipart.NewReader(source.DetachReader(), source.Boundary())
+		err := comp.AddFromMultipartReader(reader, func(part *multipart.Part) bool {
+			part.Header.Set("X-Copied", "true")
+			return part.FormName() != "skipped"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		comp.AddField("after", "2")
+		if _, err := comp.Size(); err == nil {
+			t.Error("composer: unexpected size")
+		}
+		body, err := ioutil.ReadAll(comp.DetachReader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		form := multipart.NewReader(bytes.NewReader(body), comp.Boundary())
+		var parts []string
+		for {
+			part, err := form.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(part)
+			parts = append(parts, part.FormName()+":"+string(content)+":"+part.Header.Get("X-Copied"))
+		}
+		expected := "foo:bar:true,file:test:true,after:2:"
+		if !first {
+			expected = "before:1:," + expected
+		}
+		if actual := strings.Join(parts, ","); actual != expected {
+			t.Error("composer: unexpected parts -", actual)
+		}
+		if first && !bytes.HasPrefix(body, []byte("--")) {
+			t.Errorf("composer: unexpected start - %q", body)
+		}
+	}
+}
+
+func TestComposer_AddFieldPipe(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		_, err := pipeWriter.Write([]byte{42})
+		pipeWriter.CloseWithError(err)
+	}()
+	comp := composer.NewComposer()
+	comp.AddFieldPipe("foo", pipeReader, 1)
+	out, size, err := comp.DetachReaderWithSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(body)) != size {
+		t.Error("composer: unexpected size -", size, len(body))
+	}
+}
+
+func TestComposer_AddCharsetField(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddCharsetField("utf-8")
+	var names []string
+	comp.Parts()(func(name string, header textproto.MIMEHeader) bool {
+		names = append(names, name)
+		return true
+	})
+	if strings.Join(names, ",") != "_charset_,foo" {
+		t.Error("composer: unexpected parts -", names)
+	}
+}
+
+func TestComposer_SizeWithoutClosing(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	partSize, _ := comp.PartSize(0)
+	if sizeWithout, err := comp.SizeWithoutClosing(); err != nil || sizeWithout != partSize ||
+		sizeWithout != size-int64(len(comp.ClosingBoundaryLine())) {
+		t.Error("composer: unexpected size -", sizeWithout, err)
+	}
+}
+
+func TestComposer_AddPreEncodedFile(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddPreEncodedFile("file", "test.bin", "base64", strings.NewReader("dGVzdA=="))
+	body, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, []byte("Content-Transfer-Encoding: base64\r\nContent-Type: application/octet-stream\r\n\r\ndGVzdA==\r\n")) {
+		t.Errorf("composer: unexpected body - %q", body)
+	}
+}
+
+func TestNewFrom(t *testing.T) {
+	template, _ := composer.NewComposerWithBoundaryLength(8)
+	template.SetBoundaryPrefix("profile-")
+	template.CloseReaders = false
+	template.DefaultContentType = "application/x-binary"
+	template.AddField("foo", "bar")
+	comp := composer.NewFrom(template)
+	if comp.CloseReaders || comp.DefaultContentType != "application/x-binary" || !comp.IsEmpty() {
+		t.Error("composer: configuration not copied")
+	}
+	if boundary := comp.Boundary(); boundary == template.Boundary() ||
+		!strings.HasPrefix(boundary, "profile-") || len(boundary) != 24 {
+		t.Error("composer: unexpected boundary -", boundary)
+	}
+	if template.IsEmpty() {
+		t.Error("composer: template modified")
+	}
+}
+
+func TestComposer_Require(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.Require("foo", "file")
+	comp.AddField("foo", "bar")
+	if err := comp.Validate(); !errors.Is(err, composer.ErrMissingField) {
+		t.Error("composer: unexpected validation error -", err)
+	}
+	if _, _, err := comp.DetachReaderWithSize(); !errors.Is(err, composer.ErrMissingField) {
+		t.Error("composer: unexpected detach error -", err)
+	}
+	comp.AddFileReader("file", "test.txt", strings.NewReader("test"))
+	if err := comp.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestComposer_AddPart_canonicalKeys(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	header := textproto.MIMEHeader{
+		"content-type":        {"text/plain"},
+		"content-disposition": {`form-data; name="foo"`},
+	}
+	comp.Require("foo")
+	comp.AddPart(header, strings.NewReader("bar"))
+	if err := comp.Validate(); err != nil {
+		t.Error(err)
+	}
+	if infos := comp.PartInfos(); infos[0].Name != "foo" || infos[0].ContentType != "text/plain" {
+		t.Errorf("composer: unexpected part - %+v", infos[0])
+	}
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	if !strings.Contains(string(out), "Content-Disposition: form-data; name=\"foo\"\r\nContent-Type: text/plain\r\n") {
+		t.Errorf("composer: unexpected header - %q", out)
+	}
+}
+
+type sleepyReader struct {
+	source io.Reader
+	delay  time.Duration
+}
+
+func (r *sleepyReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.source.Read(p[:1])
+}
+
+func TestComposer_AddFileReaderDeadline(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReaderDeadline("file", "test.txt", strings.NewReader("test"), time.Minute)
+	if _, err := ioutil.ReadAll(comp.DetachReader()); err != nil {
+		t.Error(err)
+	}
+	reader := &sleepyReader{strings.NewReader("test"), 10 * time.Millisecond}
+	comp.AddFileReaderDeadline("file", "test.txt", reader, time.Millisecond)
+	if _, err := ioutil.ReadAll(comp.DetachReader()); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_WriteEML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "message.eml")
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	if err := comp.WriteEML(path); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	msg, err := mail.ReadMessage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := msg.Header.Get("MIME-Version"); version != "1.0" {
+		t.Error("composer: unexpected MIME version -", version)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(msg.Body, params["boundary"]).ReadForm(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := form.Value["foo"]; len(value) != 1 || value[0] != "bar" {
+		t.Error("composer: unexpected field -", value)
+	}
+}
+
+func TestDefaultCloseReaders(t *testing.T) {
+	composer.DefaultCloseReaders = false
+	defer func() { composer.DefaultCloseReaders = true }()
+	if comp := composer.NewComposer(); comp.CloseReaders {
+		t.Error("composer: default not applied")
+	}
+}
+
+func TestComposer_AddFromChannel(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("first", "1")
+	field, file := comp.CreateFieldPart("second"), comp.CreateFilePart("file", "test.txt")
+	ch := make(chan composer.Part)
+	go func() {
+		ch <- composer.Part{Header: field, Reader: strings.NewReader("2")}
+		ch <- composer.Part{Header: file, Reader: strings.NewReader("test")}
+		close(ch)
+	}()
+	boundary := comp.Boundary()
+	reader := comp.AddFromChannel(ch)
+	defer reader.Close()
+	form, err := multipart.NewReader(reader, boundary).ReadForm(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(form.Value["first"]) != 1 || len(form.Value["second"]) != 1 || len(form.File["file"]) != 1 {
+		t.Error("composer: unexpected form -", form.Value, form.File)
+	}
+}
+
+func TestEscapeQuotes(t *testing.T) {
+	if escaped := composer.EscapeQuotes(`a\b"c`); escaped != `a\\b\"c` {
+		t.Error("composer: unexpected escaping -", escaped)
+	}
+}
+
+func TestComposer_AddFileReaderMax(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReaderMax("file", "test.txt", strings.NewReader("test"), 4)
+	if _, err := ioutil.ReadAll(comp.DetachReader()); err != nil {
+		t.Error(err)
+	}
+	comp.AddFileReaderMax("file", "test.txt", strings.NewReader("test"), 3)
+	if _, err := ioutil.ReadAll(comp.DetachReader()); !errors.Is(err, composer.ErrPartTooLong) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_AddRaw(t *testing.T) {
+	field := composer.PrecomputedField("foo", "bar")
+	for i := 0; i < 2; i++ {
+		comp := composer.NewComposer()
+		comp.SetBoundary("3a494cd3")
+		comp.AddRaw(field)
+		expected := composer.NewComposer()
+		expected.SetBoundary("3a494cd3")
+		expected.AddField("foo", "bar")
+		out, _ := ioutil.ReadAll(comp.DetachReader())
+		if exp, _ := ioutil.ReadAll(expected.DetachReader()); !bytes.Equal(out, exp) {
+			t.Errorf("composer: unexpected body - %q", out)
+		}
+	}
+}
+
+func TestComposer_builtinContentTypes(t *testing.T) {
+	comp := composer.NewComposer()
+	if contentType := comp.CreateFilePart("file", "test.JS").Get("Content-Type"); contentType != "text/javascript; charset=utf-8" {
+		t.Error("composer: unexpected content type -", contentType)
+	}
+	comp.SystemContentTypes = true
+	if contentType := comp.CreateFilePart("file", "test.js").Get("Content-Type"); contentType != mime.TypeByExtension(".js") {
+		t.Error("composer: unexpected content type -", contentType)
+	}
+}
+
+func TestComposer_DetachReaderReplayable(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddFile("file", "demo/test.txt")
+	body, getBody, size, err := comp.DetachReaderReplayable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(body)
+	body.Close()
+	if int64(len(out)) != size {
+		t.Error("composer: unexpected size -", size)
+	}
+	for i := 0; i < 2; i++ {
+		body, err := getBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := ioutil.ReadAll(body)
+		if err := body.Close(); err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(again, out) {
+			t.Errorf("composer: unexpected body - %q", again)
+		}
+	}
+}
+
+func TestComposer_DetachReaderReplayable_notSeekable(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReader("file", "test.txt", sizeio.SizeReader(io.MultiReader(strings.NewReader("test")), 4))
+	if _, _, _, err := comp.DetachReaderReplayable(); !errors.Is(err, composer.ErrNotReplayable) {
+		t.Error("composer: unexpected error -", err)
+	}
+	if comp.IsEmpty() {
+		t.Error("composer: parts detached")
+	}
+}
+
+func TestComposer_AddFileReaderSharedType(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddFileReaderSharedType("files", "text/plain", []composer.FilePart{
+		{"a.txt", strings.NewReader("first")},
+		{"b.log", strings.NewReader("second")},
+	})
+	boundary := comp.Boundary()
+	form, err := multipart.NewReader(comp.DetachReader(), boundary).ReadForm(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := form.File["files"]
+	if len(files) != 2 || files[1].Filename != "b.log" {
+		t.Fatal("composer: unexpected files -", files)
+	}
+	for _, file := range files {
+		if contentType := file.Header.Get("Content-Type"); contentType != "text/plain" {
+			t.Error("composer: unexpected content type -", contentType)
+		}
+	}
+}
+
+func TestComposer_DelimiterPrefix(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	comp.NoDelimiterPrefix = true
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	expected := "3a494cd3\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n3a494cd3--\r\n"
+	if string(out) != expected {
+		t.Errorf("composer: unexpected body - %q", out)
+	}
+	if size != int64(len(out)) {
+		t.Error("composer: unexpected size -", size)
+	}
+}
+
+func TestComposer_DelimiterPrefix_empty(t *testing.T) {
+	comp := &composer.Composer{}
+	comp.SetBoundary("3a494cd3")
+	if line := string(comp.BoundaryLine()); line != "--3a494cd3\r\n" {
+		t.Errorf("composer: unexpected boundary line - %q", line)
+	}
+}
+
+func TestComposer_DelimiterPrefix_validate(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	comp.DelimiterPrefix = "=="
+	comp.AddField("foo", "--3a494cd3")
+	if err := comp.Validate(); err != nil {
+		t.Error(err)
+	}
+	comp.AddField("bar", "==3a494cd3")
+	if err := comp.Validate(); !errors.Is(err, composer.ErrInvalidPart) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_ChunkedSizeEstimate(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", strings.NewReader(strings.Repeat("x", 100)))
+	estimate, err := comp.ChunkedSizeEstimate(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(comp.DetachReader())
+	var buf bytes.Buffer
+	writer := httputil.NewChunkedWriter(&buf)
+	for len(body) > 0 {
+		n := 32
+		if n > len(body) {
+			n = len(body)
+		}
+		writer.Write(body[:n])
+		body = body[n:]
+	}
+	writer.Close()
+	// the chunked writer leaves the final line break to the caller
+	if size := int64(buf.Len() + 2); estimate != size {
+		t.Errorf("composer: unexpected estimate %d instead of %d", estimate, size)
+	}
+	if _, err := comp.ChunkedSizeEstimate(0); !errors.Is(err, composer.ErrInvalidChunkSize) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_PartInfos(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.AddFileReader("file", "test.txt", io.MultiReader(strings.NewReader("test")))
+	infos := comp.PartInfos()
+	expected := []composer.PartInfo{
+		{Name: "foo", Size: 3},
+		{Name: "file", FileName: "test.txt", ContentType: "text/plain; charset=utf-8", Size: -1},
+	}
+	if len(infos) != len(expected) {
+		t.Fatal("composer: unexpected part count -", len(infos))
+	}
+	for i, info := range infos {
+		if info != expected[i] {
+			t.Errorf("composer: unexpected part %d - %+v", i, info)
+		}
+	}
+}
+
+func TestComposer_DetachReaderWith(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	comp.AddField("foo", "bar")
+	count := 0
+	reader := comp.DetachReaderWith(func(readers []io.Reader) io.Reader {
+		count = len(readers)
+		return io.MultiReader(readers...)
+	})
+	out, _ := ioutil.ReadAll(reader)
+	if count != 3 {
+		t.Error("composer: unexpected reader count -", count)
+	}
+	expected := "--3a494cd3\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n--3a494cd3--\r\n"
+	if string(out) != expected {
+		t.Errorf("composer: unexpected body - %q", out)
+	}
+}
+
+func TestComposer_Seal(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	comp.Seal()
+	comp.AddField("baz", "qux")
+	if err := comp.Err(); !errors.Is(err, composer.ErrSealed) {
+		t.Error("composer: unexpected error -", err)
+	}
+	if infos := comp.PartInfos(); len(infos) != 1 {
+		t.Error("composer: unexpected part count -", len(infos))
+	}
+	if err := comp.AddFile("file", "demo/test.txt"); err != nil {
+		t.Error(err)
+	}
+	if err := comp.SetBoundary("3a494cd3"); !errors.Is(err, composer.ErrSealed) {
+		t.Error("composer: unexpected boundary error -", err)
+	}
+}
+
+func TestComposer_Seal_ownedReaders(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.Seal()
+	part := &seekCloser{Reader: strings.NewReader("part")}
+	comp.AddPart(comp.CreateFieldPart("part"), part)
+	shared := &seekCloser{Reader: strings.NewReader("shared")}
+	comp.AddFileReaderSharedType("shared", "text/plain",
+		[]composer.FilePart{{Name: "shared.txt", Reader: shared}})
+	group := &seekCloser{Reader: strings.NewReader("group")}
+	comp.AddFileGroup("group", []composer.FilePart{{Name: "group.txt", Reader: group}})
+	if !part.closed || !shared.closed || !group.closed {
+		t.Error("composer: rejected readers not closed")
+	}
+	if !comp.IsEmpty() {
+		t.Error("composer: parts added")
+	}
+	comp.CloseReaders = false
+	kept := &seekCloser{Reader: strings.NewReader("kept")}
+	comp.AddFieldReader("kept", kept)
+	if kept.closed {
+		t.Error("composer: reader not owned closed")
+	}
+}
+
+func TestComposer_Strict(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.Strict = true
+	comp.AddField("foo", "bar")
+	if err := comp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(comp.DetachReader())
+	comp.AddField("foo", "bar")
+	if err := comp.Err(); !errors.Is(err, composer.ErrSealed) {
+		t.Error("composer: unexpected error -", err)
+	}
+	if err := comp.ResetBoundary(); !errors.Is(err, composer.ErrSealed) {
+		t.Error("composer: unexpected boundary error -", err)
+	}
+}
+
+func TestComposer_InsertPart(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("first", "1")
+	comp.AddField("third", "3")
+	comp.InsertPart(1, comp.CreateFieldPart("second"), strings.NewReader("2"))
+	comp.InsertPart(3, comp.CreateFieldPart("fourth"), strings.NewReader("4"))
+	var names []string
+	for _, info := range comp.PartInfos() {
+		names = append(names, info.Name)
+	}
+	if strings.Join(names, ",") != "first,second,third,fourth" {
+		t.Error("composer: unexpected order -", names)
+	}
+	boundary := comp.Boundary()
+	if _, err := multipart.NewReader(comp.DetachReader(), boundary).ReadForm(1024); err != nil {
+		t.Error(err)
+	}
+	comp.InsertPart(1, comp.CreateFieldPart("fifth"), strings.NewReader("5"))
+	if err := comp.Err(); !errors.Is(err, composer.ErrInvalidPartIndex) {
+		t.Error("composer: unexpected error -", err)
+	}
+}
+
+func TestComposer_TrailingSeparator(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	comp.TrailingSeparator = "\r\n"
+	comp.AddField("foo", "bar")
+	size, _ := comp.Size()
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	expected := "--3a494cd3\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n\r\n--3a494cd3--\r\n"
+	if string(out) != expected {
+		t.Errorf("composer: unexpected body - %q", out)
+	}
+	if size != int64(len(out)) {
+		t.Error("composer: unexpected size -", size)
+	}
+}
+
+func TestComposer_RedactField(t *testing.T) {
+	comp := composer.NewComposer(composer.WithBoundary("b"))
+	comp.RedactField("password")
+	comp.AddField("user", "joe")
+	comp.AddField("password", "secret")
+	expected := "# multipart body, 2 parts, 128 bytes\n" +
+		"0: user = \"joe\", 55 bytes\n" +
+		"1: password = ***, 64 bytes\n"
+	if actual := comp.DebugString(); actual != expected {
+		t.Errorf("composer: unexpected summary - %q", actual)
+	}
+}
+
+func TestComposer_PartSize_fields(t *testing.T) {
+	comp := composer.NewComposer()
+	for i, name := range []string{"foo", `quoted "name"`, "empty"} {
+		before, _ := comp.Size()
+		comp.AddField(name, strings.Repeat("x", i))
+		after, _ := comp.Size()
+		size, ok := comp.PartSize(i)
+		if !ok {
+			t.Fatal("composer: field size not computed")
+		}
+		if size != after-before {
+			t.Errorf("composer: unexpected size %d of field %d instead of %d", size, i, after-before)
+		}
+	}
+}
+
+type seekCloser struct {
+	*strings.Reader
+	closed bool
+}
+
+func (r *seekCloser) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestComposer_DetachReaderReplayable_owned(t *testing.T) {
+	comp := composer.NewComposer()
+	reader := &seekCloser{Reader: strings.NewReader("test")}
+	comp.AddFileReader("file", "test.txt", reader)
+	if _, _, _, err := comp.DetachReaderReplayable(); !errors.Is(err, composer.ErrNotReplayable) {
+		t.Error("composer: unexpected error -", err)
+	}
+	comp.Close()
+	if !reader.closed {
+		t.Error("composer: owned reader not closed")
+	}
+	reader = &seekCloser{Reader: strings.NewReader("test")}
+	comp.AddFileReaderOwned("file", "test.txt", reader, false)
+	body, getBody, _, err := comp.DetachReaderReplayable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if body, err = getBody(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadAll(body); !strings.Contains(string(content), "\r\n\r\ntest\r\n") {
+		t.Errorf("composer: unexpected body - %q", content)
+	}
+	if reader.closed {
+		t.Error("composer: shared reader closed")
+	}
+}
+
+func TestComposer_AddFromChannel_noHeader(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("3a494cd3")
+	ch := make(chan composer.Part, 1)
+	ch <- composer.Part{Reader: strings.NewReader("content")}
+	close(ch)
+	out, _ := ioutil.ReadAll(comp.AddFromChannel(ch))
+	if expected := "--3a494cd3\r\n\r\ncontent\r\n--3a494cd3--\r\n"; string(out) != expected {
+		t.Errorf("composer: unexpected body - %q", out)
+	}
+}
@@ -2,8 +2,11 @@ package composer_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/textproto"
 	"os"
+	"strconv"
 	"strings"
 
 	composer "github.com/prantlf/go-multipart-composer"
@@ -59,6 +62,18 @@ func Example() {
 	// --1879bcd06ac39a4d8fa5--
 }
 
+func ExampleDataURI() {
+	// Encode a small content to a data URI instead of a multipart section.
+	uri, err := composer.DataURI(strings.NewReader("foo"), "text/plain")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print(uri)
+	// Output:
+	// data:text/plain;base64,Zm9v
+}
+
 func ExampleComposer() {
 	// Create an invalid composer for results returned in case of error.
 	comp := composer.Composer{}
@@ -99,6 +114,20 @@ func ExampleComposer_SetBoundary() {
 	// 3a494cd3b73de6555202
 }
 
+func ExampleComposer_SetBoundaryFromContentType() {
+	comp := composer.NewComposer()
+
+	// Reuse the boundary of an incoming multipart message.
+	if err := comp.SetBoundaryFromContentType(
+		"multipart/form-data; boundary=3a494cd3b73de6555202"); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print(comp.Boundary())
+	// Output:
+	// 3a494cd3b73de6555202
+}
+
 func ExampleComposer_ResetBoundary() {
 	comp := composer.NewComposer()
 	comp.SetBoundary("1")
@@ -122,6 +151,31 @@ func ExampleComposer_FormDataContentType() {
 	// Content-Type: multipart/form-data; boundary=1879bcd06ac39a4d8fa5
 }
 
+func ExampleComposer_HeaderFunc() {
+	comp := composer.NewComposer()
+
+	// Add a header with the part index to every part.
+	comp.HeaderFunc = func(index int, header textproto.MIMEHeader) {
+		header.Set("X-Index", strconv.Itoa(index))
+	}
+	comp.AddField("foo", "bar")
+	comp.AddField("baz", "qux")
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	// X-Index: 0
+	//
+	// bar
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="baz"
+	// X-Index: 1
+	//
+	// qux
+	// --1879bcd06ac39a4d8fa5--
+}
+
 func ExampleComposer_AddField() {
 	comp := composer.NewComposer()
 
@@ -137,6 +191,21 @@ func ExampleComposer_AddField() {
 	// --1879bcd06ac39a4d8fa5--
 }
 
+func ExampleComposer_AddRawPart() {
+	comp := composer.NewComposer()
+
+	// Add a part rendered earlier, including its header.
+	comp.AddRawPart([]byte("Content-Disposition: form-data; name=\"foo\"\r\n\r\nbar"))
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	//
+	// bar
+	// --1879bcd06ac39a4d8fa5--
+}
+
 func ExampleComposer_AddFieldReader() {
 	comp := composer.NewComposer()
 
@@ -152,6 +221,98 @@ func ExampleComposer_AddFieldReader() {
 	// --1879bcd06ac39a4d8fa5--
 }
 
+func ExampleComposer_AddFieldReaderNamed() {
+	comp := composer.NewComposer()
+
+	// Add a field with a file name, but without a content type.
+	comp.AddFieldReaderNamed("foo", "bar.txt", strings.NewReader("baz"))
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"; filename="bar.txt"
+	//
+	// baz
+	// --1879bcd06ac39a4d8fa5--
+}
+
+func ExampleComposer_AddFieldReaderWithType() {
+	comp := composer.NewComposer()
+
+	// Add a field with a content type, but without a file name.
+	comp.AddFieldReaderWithType("foo", "text/csv", strings.NewReader("bar,baz"))
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	// Content-Type: text/csv
+	//
+	// bar,baz
+	// --1879bcd06ac39a4d8fa5--
+}
+
+func ExampleComposer_AddJSONField() {
+	comp := composer.NewComposer()
+
+	// Add a field with a value serialized to JSON.
+	comp.JSONContentType = true
+	if err := comp.AddJSONField("foo", map[string]int{"bar": 1}); err != nil {
+		log.Fatal(err)
+	}
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	// Content-Type: application/json
+	//
+	// {"bar":1}
+	// --1879bcd06ac39a4d8fa5--
+}
+
+func ExampleComposer_PrependField() {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+
+	// Insert a field before the fields added earlier.
+	comp.PrependField("signature", "baz")
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="signature"
+	//
+	// baz
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	//
+	// bar
+	// --1879bcd06ac39a4d8fa5--
+}
+
+func ExampleComposer_SortParts() {
+	comp := composer.NewComposer()
+	comp.AddFileReader("file", "test.txt", strings.NewReader("text file content"))
+	comp.AddField("foo", "bar")
+
+	// Move the text fields before the files.
+	comp.SortParts(composer.FieldsFirst())
+
+	demo.PrintRequestBody(comp.DetachReader())
+	// Output:
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="foo"
+	//
+	// bar
+	// --1879bcd06ac39a4d8fa5
+	// Content-Disposition: form-data; name="file"; filename="test.txt"
+	// Content-Type: text/plain; charset=utf-8
+	//
+	// text file content
+	// --1879bcd06ac39a4d8fa5--
+}
+
 func ExampleComposer_AddFile() {
 	comp := composer.NewComposer()
 
@@ -220,6 +381,21 @@ func ExampleComposer_DetachReaderWithSize() {
 	// --1879bcd06ac39a4d8fa5--
 }
 
+func ExampleComposer_Size() {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+
+	// Get the size of the multipart message before detaching it.
+	size, err := comp.Size()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Size: %d", size)
+	// Output:
+	// Size: 181
+}
+
 func ExampleComposer_Clear() {
 	comp := composer.NewComposer()
 	comp.AddField("foo", "bar")
@@ -266,11 +442,6 @@ func ExampleComposer_Close() {
 	defer file.Close()
 	comp.AddFileReader("file", "test.txt", file)
 
-	// Adding a file by path is impossible if automatic closing is disabled.
-	if err := comp.AddFile("file", "demo/test.txt"); err == nil {
-		log.Fatal("added")
-	}
-
 	// Getting the final reader or closing the composer will not close the file.
 	reqBody := comp.DetachReader()
 	comp.Close()
@@ -289,3 +460,20 @@ func ExampleComposer_Close() {
 	// text file content
 	// --1879bcd06ac39a4d8fa5--
 }
+
+func ExampleComposer_DebugString() {
+	comp := composer.NewComposer()
+	comp.RedactField("password")
+
+	comp.AddField("comment", "text")
+	comp.AddField("password", "secret")
+	// Add a file content supplied by a reader without a known size.
+	comp.AddFileReader("file", "test.txt", ioutil.NopCloser(strings.NewReader("test")))
+
+	fmt.Print(comp.DebugString())
+	// Output:
+	// # multipart body, 3 parts, unknown size
+	// 0: comment = "text", 118 bytes
+	// 1: password = ***, 123 bytes
+	// 2: file (test.txt), unknown size
+}
@@ -0,0 +1,125 @@
+// Package composertest provides utilities for testing code, which composes
+// multipart messages. It helps comparing the messages with expected content
+// regardless of the randomly generated boundary:
+//
+//     out, _ := ioutil.ReadAll(comp.DetachReader())
+//     out = composertest.NormalizeBoundary(out, "boundary")
+//     golden, _ := ioutil.ReadFile("testdata/message.golden")
+//     if !bytes.Equal(out, golden) {
+//       t.Error("unexpected message")
+//     }
+//
+// EqualToStdlib checks the compatibility with multipart.Writer.
+package composertest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"sort"
+
+	composer "github.com/prantlf/go-multipart-composer"
+)
+
+// NormalizeBoundary replaces the boundary of the multipart message body
+// with the placeholder. The boundary is recognised in the first delimiter
+// line of the message. If there is none, the body is returned unchanged.
+// Only the delimiter lines are changed, occurrences of the boundary
+// in the content of parts are retained.
+func NormalizeBoundary(body []byte, placeholder string) []byte {
+	boundary := findBoundary(body)
+	if boundary == nil {
+		return body
+	}
+	target := []byte(placeholder)
+	// delimiter lines first, because the boundary may end with dashes
+	body = bytes.ReplaceAll(body, line("\r\n--", boundary, "\r\n"), line("\r\n--", target, "\r\n"))
+	body = bytes.ReplaceAll(body, line("\r\n--", boundary, "--"), line("\r\n--", target, "--"))
+	if first := line("--", boundary, "\r\n"); bytes.HasPrefix(body, first) {
+		body = append(line("--", target, "\r\n"), body[len(first):]...)
+	}
+	return body
+}
+
+// line returns a new slice with the boundary between prefix and suffix.
+func line(prefix string, boundary []byte, suffix string) []byte {
+	return append(append([]byte(prefix), boundary...), suffix...)
+}
+
+func findBoundary(body []byte) []byte {
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if !bytes.HasPrefix(line, []byte("--")) || len(line) < 3 {
+			continue
+		}
+		boundary := line[2:]
+		// An empty message contains only the closing delimiter line.
+		closing := append(append([]byte("--"), boundary...), "--"...)
+		if bytes.HasSuffix(boundary, []byte("--")) && !bytes.Contains(body, closing) {
+			boundary = boundary[:len(boundary)-2]
+		}
+		if len(boundary) > 0 {
+			return boundary
+		}
+	}
+	return nil
+}
+
+// EqualToStdlib composes a form with the fields both by Composer and by
+// multipart.Writer from the standard library, using the same boundary,
+// and compares the messages. The fields are added in the order of their
+// names. If the messages differ, the second return value describes
+// the first difference. It demonstrates that servers parsing messages
+// from the standard library will accept messages from Composer too.
+func EqualToStdlib(fields map[string]string) (bool, string) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var expected bytes.Buffer
+	writer := multipart.NewWriter(&expected)
+	comp := composer.NewComposer()
+	if err := comp.SetBoundary(writer.Boundary()); err != nil {
+		return false, err.Error()
+	}
+	for _, name := range names {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return false, err.Error()
+		}
+		comp.AddField(name, fields[name])
+	}
+	if err := writer.Close(); err != nil {
+		return false, err.Error()
+	}
+	actual, err := ioutil.ReadAll(comp.DetachReader())
+	if err != nil {
+		return false, err.Error()
+	}
+	return compare(actual, expected.Bytes())
+}
+
+// compare returns true if the messages are equal, otherwise it describes
+// the first difference.
+func compare(actual, expected []byte) (bool, string) {
+	if bytes.Equal(actual, expected) {
+		return true, ""
+	}
+	offset := 0
+	for offset < len(actual) && offset < len(expected) && actual[offset] == expected[offset] {
+		offset++
+	}
+	return false, fmt.Sprintf("messages differ at offset %d: composer %q, stdlib %q",
+		offset, excerpt(actual, offset), excerpt(expected, offset))
+}
+
+// excerpt returns up to 20 bytes of the message starting at offset.
+func excerpt(message []byte, offset int) []byte {
+	end := offset + 20
+	if end > len(message) {
+		end = len(message)
+	}
+	return message[offset:end]
+}
@@ -0,0 +1,68 @@
+package composertest_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	composer "github.com/prantlf/go-multipart-composer"
+	"github.com/prantlf/go-multipart-composer/composertest"
+)
+
+func TestNormalizeBoundary_parts(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", "bar")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	out = composertest.NormalizeBoundary(out, "boundary")
+	expected := "--boundary\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n--boundary--\r\n"
+	if string(out) != expected {
+		t.Error("composertest: unexpected body with parts", string(out))
+	}
+}
+
+func TestNormalizeBoundary_empty(t *testing.T) {
+	comp := composer.NewComposer()
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	out = composertest.NormalizeBoundary(out, "boundary")
+	if string(out) != "\r\n--boundary--\r\n" {
+		t.Error("composertest: unexpected empty body", string(out))
+	}
+}
+
+func TestNormalizeBoundary_dashes(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.SetBoundary("foo--")
+	comp.AddField("foo", "bar")
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	out = composertest.NormalizeBoundary(out, "boundary")
+	expected := "--boundary\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\nbar\r\n--boundary--\r\n"
+	if string(out) != expected {
+		t.Error("composertest: unexpected body with dashes", string(out))
+	}
+}
+
+func TestNormalizeBoundary_content(t *testing.T) {
+	comp := composer.NewComposer()
+	comp.AddField("foo", comp.Boundary())
+	boundary := comp.Boundary()
+	out, _ := ioutil.ReadAll(comp.DetachReader())
+	out = composertest.NormalizeBoundary(out, "boundary")
+	expected := "--boundary\r\nContent-Disposition: form-data; name=\"foo\"\r\n\r\n" +
+		boundary + "\r\n--boundary--\r\n"
+	if string(out) != expected {
+		t.Error("composertest: unexpected body with boundary in content", string(out))
+	}
+}
+
+func TestNormalizeBoundary_none(t *testing.T) {
+	out := composertest.NormalizeBoundary([]byte("foo"), "boundary")
+	if string(out) != "foo" {
+		t.Error("composertest: unexpected body without boundary", string(out))
+	}
+}
+
+func TestEqualToStdlib(t *testing.T) {
+	fields := map[string]string{"foo": "bar", "quoted\"name": "multi\r\nline", "empty": ""}
+	if equal, diff := composertest.EqualToStdlib(fields); !equal {
+		t.Error("composertest: output differs from stdlib -", diff)
+	}
+}
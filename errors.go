@@ -0,0 +1,70 @@
+package composer
+
+import "errors"
+
+// Errors returned by the Composer, directly or wrapped with more details.
+// They can be recognized by errors.Is.
+var (
+	// ErrBoundaryEmpty is returned when setting an empty boundary.
+	ErrBoundaryEmpty = errors.New("multipart: empty boundary")
+	// ErrBoundaryTooLong is returned when setting a boundary longer than
+	// 70 characters.
+	ErrBoundaryTooLong = errors.New("multipart: boundary too long")
+	// ErrInvalidBoundaryCharacter is returned when setting a boundary
+	// with characters not allowed by RFC 2046.
+	ErrInvalidBoundaryCharacter = errors.New("multipart: invalid boundary character")
+	// ErrInvalidBoundaryLength is returned by NewComposerWithBoundaryLength
+	// for a count of random bytes out of the allowed range.
+	ErrInvalidBoundaryLength = errors.New("multipart: invalid boundary length")
+	// ErrSetBoundaryAfterAdd is returned when changing the boundary after
+	// parts were added.
+	ErrSetBoundaryAfterAdd = errors.New("multipart: boundary changed after add")
+	// ErrSealed is returned when a sealed Composer is changed. See Seal
+	// and Strict.
+	ErrSealed = errors.New("multipart: composer sealed")
+	// ErrNotMultipart is returned by SetBoundaryFromContentType for
+	// content types other than multipart.
+	ErrNotMultipart = errors.New("multipart: content type not multipart")
+	// ErrBoundaryMissing is returned by SetBoundaryFromContentType for
+	// content types without the boundary parameter.
+	ErrBoundaryMissing = errors.New("multipart: boundary missing in content type")
+	// ErrNilReader is recorded when a nil reader is passed to an add method.
+	ErrNilReader = errors.New("multipart: nil reader")
+	// ErrDuplicateField is recorded when a field name is used more than once
+	// and RejectDuplicateFields is set.
+	ErrDuplicateField = errors.New("multipart: duplicate field")
+	// ErrMissingField is returned by Validate and DetachReaderWithSize,
+	// if a field registered by Require has not been added.
+	ErrMissingField = errors.New("multipart: missing required field")
+	// ErrNoPart is recorded by AppendToLastPart if no part has been added.
+	ErrNoPart = errors.New("multipart: no part to append to")
+	// ErrInvalidPartIndex is recorded by InsertPart for an index out of range.
+	ErrInvalidPartIndex = errors.New("multipart: invalid part index")
+	// ErrInvalidBlockSize is recorded by AddFileReaderPadded for a block
+	// size out of the allowed range.
+	ErrInvalidBlockSize = errors.New("multipart: invalid block size")
+	// ErrInvalidChunkSize is returned by ChunkedSizeEstimate for a chunk
+	// size, which is not positive.
+	ErrInvalidChunkSize = errors.New("multipart: invalid chunk size")
+	// ErrUnknownFileIndex is returned by AddGraphQLUpload for a file map
+	// key, which does not point to a file.
+	ErrUnknownFileIndex = errors.New("multipart: unknown file index")
+	// ErrReaderWithoutSize is returned when a size is needed, but some
+	// reader does not provide it.
+	ErrReaderWithoutSize = errors.New("multipart: reader without size")
+	// ErrInvalidPart is returned by Validate for a part breaking RFC 2046.
+	ErrInvalidPart = errors.New("multipart: invalid part")
+	// ErrMessageTooLong is returned by the reader of a message longer than
+	// allowed by MaxSize or DetachReaderLimited.
+	ErrMessageTooLong = errors.New("multipart: message size limit exceeded")
+	// ErrPartTooLong is returned by the reader of a message with a part
+	// longer than allowed by AddFileReaderMax.
+	ErrPartTooLong = errors.New("multipart: part size limit exceeded")
+	// ErrSizeMismatch is returned by Close of the detached reader, if
+	// VerifySizes is set and a reader produced a different count of bytes
+	// than declared.
+	ErrSizeMismatch = errors.New("multipart: size mismatch")
+	// ErrNotReplayable is returned by DetachReaderReplayable, if some reader
+	// cannot be rewound.
+	ErrNotReplayable = errors.New("multipart: reader cannot be replayed")
+)
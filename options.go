@@ -0,0 +1,28 @@
+package composer
+
+// Option modifies the configuration of a Composer created by NewComposer.
+// Errors of options are recorded and returned by Err.
+type Option func(*Composer)
+
+// WithBoundary sets the boundary like SetBoundary does.
+func WithBoundary(boundary string) Option {
+	return func(c *Composer) {
+		if err := c.SetBoundary(boundary); err != nil {
+			c.fail(err)
+		}
+	}
+}
+
+// WithoutCloseReaders sets CloseReaders to false.
+func WithoutCloseReaders() Option {
+	return func(c *Composer) {
+		c.CloseReaders = false
+	}
+}
+
+// WithMaxSize sets MaxSize to limit the size of the message.
+func WithMaxSize(max int64) Option {
+	return func(c *Composer) {
+		c.MaxSize = max
+	}
+}
@@ -0,0 +1,398 @@
+package composer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"time"
+
+	"github.com/prantlf/go-sizeio"
+)
+
+// gzipReader compresses the content of the source reader on the fly,
+// without using goroutines and pipes.
+type gzipReader struct {
+	source io.Reader
+	writer *gzip.Writer
+	buf    bytes.Buffer
+	chunk  []byte
+	done   bool
+}
+
+func newGzipReader(source io.Reader) *gzipReader {
+	r := &gzipReader{source: source, chunk: make([]byte, 32*1024)}
+	r.writer = gzip.NewWriter(&r.buf)
+	return r
+}
+
+func (r *gzipReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		n, err := r.source.Read(r.chunk)
+		if n > 0 {
+			if _, err := r.writer.Write(r.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF {
+			if err := r.writer.Close(); err != nil {
+				return 0, err
+			}
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+type gzipReadCloser struct {
+	*gzipReader
+	closer io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// gunzipReader decompresses the content of a file and closes both
+// the decompressor and the file.
+type gunzipReader struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r *gunzipReader) Close() error {
+	err := r.Reader.Close()
+	if fileErr := r.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// compress returns a reader compressing the content of the source reader,
+// which is closable if the source reader is closable.
+func compress(source io.Reader) io.Reader {
+	reader := newGzipReader(source)
+	if closer, ok := source.(io.Closer); ok {
+		return &gzipReadCloser{reader, closer}
+	}
+	return reader
+}
+
+// withSize adds the interface sizeio.WithSize to the reader, retaining
+// the interface io.Closer, if the reader is closable.
+func withSize(reader io.Reader, size int64) io.Reader {
+	if closer, ok := reader.(io.ReadCloser); ok {
+		return sizeio.SizeReadCloser(closer, size)
+	}
+	return sizeio.SizeReader(reader, size)
+}
+
+// limitedReader fails with the error err, once the source reader produces
+// more than limit bytes. Unlike io.LimitedReader, it does not end silently.
+type limitedReader struct {
+	source io.Reader
+	left   int64
+	err    error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		// check if the source has more content than allowed
+		var probe [1]byte
+		for {
+			n, err := r.source.Read(probe[:])
+			if n > 0 {
+				return 0, r.err
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.source.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+// wrappedReader reads the compound reader through another reader, which
+// wraps it, retaining the other methods of the compound reader.
+type wrappedReader struct {
+	*composedReader
+	reader io.Reader
+}
+
+func (r *wrappedReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
+// controlledReader limits the reading speed of the source reader to rate
+// bytes per second, if rate is positive, and fails once the context is done.
+type controlledReader struct {
+	source io.Reader
+	ctx    context.Context
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func (r *controlledReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.rate > 0 {
+		if r.start.IsZero() {
+			r.start = time.Now()
+		}
+		if int64(len(p)) > r.rate {
+			p = p[:r.rate]
+		}
+	}
+	n, err := r.source.Read(p)
+	r.read += int64(n)
+	if r.rate > 0 && n > 0 {
+		elapsed := time.Duration(float64(r.read) / float64(r.rate) * float64(time.Second))
+		if wait := time.Until(r.start.Add(elapsed)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				timer.Stop()
+				return n, r.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+// sizeChecker counts the bytes produced by the source reader to be able
+// to compare them with the declared size, once the source is exhausted.
+type sizeChecker struct {
+	source io.Reader
+	size   int64
+	read   int64
+	eof    bool
+}
+
+func (r *sizeChecker) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+	r.read += int64(n)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *sizeChecker) verify() error {
+	if r.eof && r.read != r.size {
+		return fmt.Errorf("%w: read %d bytes from a reader of size %d", ErrSizeMismatch, r.read, r.size)
+	}
+	return nil
+}
+
+// lazyReader opens the source reader by the open function on the first
+// read. The reader is closed only if it has been opened.
+type lazyReader struct {
+	open   func() (io.ReadCloser, error)
+	source io.ReadCloser
+	err    error
+}
+
+func (r *lazyReader) Read(p []byte) (int, error) {
+	if r.source == nil {
+		if r.err == nil {
+			r.source, r.err = r.open()
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	return r.source.Read(p)
+}
+
+func (r *lazyReader) Close() error {
+	if r.source == nil {
+		r.err = os.ErrClosed
+		return nil
+	}
+	return r.source.Close()
+}
+
+// slowReader delays every read from the source reader.
+type slowReader struct {
+	source io.Reader
+	delay  time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.source.Read(p)
+}
+
+// errorReader fails every read with the error err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// multipartStream renders the parts obtained from the next function,
+// including their delimiter lines, when it is read. The next function
+// returns io.EOF, when there are no more parts. The content readers
+// of the parts are closed when they are exhausted, if owned is set.
+type multipartStream struct {
+	next     func() (textproto.MIMEHeader, io.Reader, error)
+	boundary []byte
+	owned    bool
+	first    bool // set if the stream starts the message
+	head     bytes.Reader
+	part     io.Reader
+	done     bool
+}
+
+// multipartReaderParts returns the next function for multipartStream,
+// which reads the parts from the source reader. The transform function,
+// if not nil, can modify a part or skip it by returning false.
+func multipartReaderParts(source *multipart.Reader, transform func(*multipart.Part) bool) func() (textproto.MIMEHeader, io.Reader, error) {
+	return func() (textproto.MIMEHeader, io.Reader, error) {
+		for {
+			part, err := source.NextPart()
+			if err != nil {
+				return nil, nil, err
+			}
+			if transform != nil && !transform(part) {
+				part.Close()
+				continue
+			}
+			return textproto.MIMEHeader(part.Header), part, nil
+		}
+	}
+}
+
+// channelParts returns the next function for multipartStream, which
+// receives the parts from the channel.
+func channelParts(ch <-chan Part) func() (textproto.MIMEHeader, io.Reader, error) {
+	return func() (textproto.MIMEHeader, io.Reader, error) {
+		part, ok := <-ch
+		if !ok {
+			return nil, nil, io.EOF
+		}
+		if part.Reader == nil {
+			return nil, nil, fmt.Errorf("%w received by AddFromChannel", ErrNilReader)
+		}
+		header := part.Header
+		if header == nil {
+			// write at least the empty line ending the header
+			header = textproto.MIMEHeader{}
+		}
+		return header, part.Reader, nil
+	}
+}
+
+func (s *multipartStream) Read(p []byte) (int, error) {
+	for {
+		if s.head.Len() > 0 {
+			return s.head.Read(p)
+		}
+		if s.part != nil {
+			n, err := s.part.Read(p)
+			if err == io.EOF {
+				if err := s.closePart(); err != nil {
+					return n, err
+				}
+				if n > 0 {
+					return n, nil
+				}
+				continue
+			}
+			return n, err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		header, part, err := s.next()
+		if err == io.EOF {
+			s.done = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var buf bytes.Buffer
+		if !s.first {
+			buf.WriteString("\r\n")
+		}
+		s.first = false
+		buf.Write(s.boundary)
+		writeHeader(&buf, header, nil)
+		s.head.Reset(buf.Bytes())
+		s.part = part
+	}
+}
+
+// Close closes the content reader of the part being read, if owned is set.
+func (s *multipartStream) Close() error {
+	return s.closePart()
+}
+
+func (s *multipartStream) closePart() error {
+	part := s.part
+	s.part = nil
+	if closer, ok := part.(io.Closer); ok && s.owned {
+		return closer.Close()
+	}
+	return nil
+}
+
+// wrappedReadCloser reads from the reader, which wraps the source reader,
+// and closes the source reader.
+type wrappedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *wrappedReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// wrap returns the reader, which wraps the source reader, retaining
+// the size and the interface io.Closer of the source reader.
+func wrap(source, reader io.Reader) io.Reader {
+	if closer, ok := source.(io.Closer); ok {
+		reader = &wrappedReadCloser{reader, closer}
+	}
+	if size, ok := sizeOf(source); ok {
+		reader = withSize(reader, size)
+	}
+	return reader
+}
+
+// deadlineReader fails, once reading from the source reader takes longer
+// than timeout since the first read.
+type deadlineReader struct {
+	source   io.Reader
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if r.deadline.IsZero() {
+		r.deadline = time.Now().Add(r.timeout)
+	} else if time.Now().After(r.deadline) {
+		return 0, fmt.Errorf("%w: part not read within %v", os.ErrDeadlineExceeded, r.timeout)
+	}
+	return r.source.Read(p)
+}